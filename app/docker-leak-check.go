@@ -1,387 +1,2380 @@
-//go:build windows
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"docker-leak-check/leakcheck"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Non-fatal errors matching this pattern are only counted, and shown in verbose mode. See printNonFatal.
+var ignoreErrorsPattern *regexp.Regexp
+var showIgnoredErrors bool
+var ignoredErrorCount int
+var ignoredErrorMu sync.Mutex
+
+// Human readable output. This is discarded in JSON mode, so stdout only holds the JSON result, unless -human-stderr
+// sends it to stderr.
+var output io.Writer = os.Stdout
+
+// Unreferenced layers and other leaks. In quiet mode, these are the only lines shown.
+var findingOutput io.Writer = os.Stdout
+
+// Fatal errors are always shown, but go to stderr in JSON mode.
+var errOutput io.Writer = os.Stdout
+
+// Outcomes of a run, which are mapped to exit codes by exitCodeMap.
+const (
+	outcomeClean    = "clean"
+	outcomeOrphans  = "orphans"
+	outcomeDangling = "dangling"
+	outcomeError    = "error"
+	outcomePartial  = "partial"
+)
+
+var exitCodeMap = map[string]int{
+	outcomeClean:    0,
+	outcomeOrphans:  1,
+	outcomeDangling: 0,
+	outcomeError:    2,
+	outcomePartial:  3,
+}
+
+const exitCodeHelp = `
+Exit codes:
+  0  no leaks found
+  1  unreferenced layers or other leaks found, more than -threshold
+  2  invalid images, incomplete layers, or the Docker runtime root could not be read
+  3  some of the layers could not be removed
+These can be changed with -exit-code-map, using the outcomes clean, orphans, dangling, error and partial.
+With -report-only, a completed scan always exits with 0.
+`
+
+// parseExitCodeMap overrides the exit codes of the outcomes listed in a mapping like "orphans=3,error=2".
+func parseExitCodeMap(mapping string) error {
+	for _, entry := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Error: invalid -exit-code-map entry %q, expected outcome=code", entry)
+		}
+		outcome := strings.TrimSpace(parts[0])
+		if _, known := exitCodeMap[outcome]; !known {
+			return fmt.Errorf("Error: unknown outcome %q in -exit-code-map", outcome)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("Error: invalid exit code for %s in -exit-code-map: %v", outcome, err)
+		}
+		exitCodeMap[outcome] = code
+	}
+	return nil
+}
+
+// fail prints a fatal error and exits.
+func fail(a ...interface{}) {
+	fmt.Fprint(errOutput, a...)
+	fmt.Fprintln(errOutput)
+	exitWith(outcomeError)
+}
+
+func exitWith(outcome string) {
+	exit(exitCodeMap[outcome])
+}
+
+// releaseLocks are called before exiting, os.Exit doesn't run deferred calls.
+var releaseLocks []func()
+
+func exit(code int) {
+	for _, release := range releaseLocks {
+		release()
+	}
+	os.Exit(code)
+}
+
+// folderList collects the -folder flag, which can be repeated or hold a comma separated list of roots.
+type folderList []string
+
+func (l *folderList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *folderList) Set(value string) error {
+	for _, folder := range strings.Split(value, ",") {
+		if folder = strings.TrimSpace(folder); folder != "" {
+			*l = append(*l, folder)
+		}
+	}
+	return nil
+}
+
+// globList collects a repeatable flag of filepath.Match patterns, which are validated right away.
+type globList []string
+
+func (l *globList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *globList) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", value, err)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a size flag that accepts a number of bytes with an optional unit, e.g. 512KB or 1.5GiB.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	return humanSize(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	factor := 1.0
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * factor)
+	return nil
+}
+
+// verbosityFlag is a boolean flag that raises the verbosity by step every time it is given, e.g. -v -v.
+type verbosityFlag struct {
+	level *int
+	step  int
+}
+
+func (v verbosityFlag) String() string {
+	if v.level == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.level)
+}
+
+func (v verbosityFlag) Set(value string) error {
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if on {
+		*v.level += v.step
+	}
+	return nil
+}
+
+func (v verbosityFlag) IsBoolFlag() bool {
+	return true
+}
+
+// options holds the command line flags that affect how a single Docker runtime root is checked.
+type options struct {
+	driver            string
+	remove            bool
+	verbose           bool
+	verbosity         int
+	strict            bool
+	deep              bool
+	untagged          bool
+	failedImports     bool
+	minReferenceAge   time.Duration
+	removeConcurrency int
+	concurrency       int
+	skipInheritance   bool
+	maxChainDepth     int
+	excludeImages     globList
+	noFollow          bool
+	dualReferences    bool
+	refCount          bool
+	minSize           byteSize
+	olderThan         time.Duration
+	jsonSummary       bool
+	jsonIncludeConfig bool
+	jsonOrphanHashes  bool
+	mapOut            string
+	prometheus        string
+	removeDangling    bool
+	quiet             bool
+	dryRun            bool
+	quarantine        string
+	logFile           string
+	format            string
+	assumeYes         bool
+	timing            bool
+	stats             bool
+	statsShared       string
+	// Layer IDs and diffs from -ignore-file, without sha256: prefix.
+	ignored map[string]struct{}
+}
+
+func main() {
+	var folders folderList
+	var opts options
+	var listChains bool
+	var ignoreErrorsMatching string
+	var compareFolder string
+	var inspectImage string
+	var exitCodeMapping string
+	var allowRunning bool
+	var reportOnly bool
+	var threshold int
+	var serveAddr string
+	var ignoreFile string
+	var compact bool
+	var humanStderr bool
+	var outputCompress bool
+	var noColor bool
+	var eventLog bool
+	var findLayer string
+	var findImage string
+	flag.Var(&folders, "folder", "Root of the Docker runtime, can be repeated or a comma separated list (default \"C:\\ProgramData\\docker\" on Windows, \"/var/lib/docker\" elsewhere)")
+	flag.StringVar(&opts.driver, "driver", leakcheck.DefaultDriver(), "Storage driver of the Docker runtime, e.g. windowsfilter or overlay2")
+	flag.BoolVar(&opts.remove, "remove", false, "Remove unreferenced layers")
+	flag.BoolVar(&opts.removeDangling, "remove-dangling", false, "Remove images that have no tag, are not part of an inheritance chain and are not used by a container")
+	flag.Var(verbosityFlag{&opts.verbosity, 1}, "verbose", "Display extra info on valid layers and the layers every image resolves to, same as -v")
+	flag.Var(verbosityFlag{&opts.verbosity, 1}, "v", "Raise the verbosity, can be repeated")
+	flag.Var(verbosityFlag{&opts.verbosity, 2}, "vv", "Like -v, and additionally show every file that is read and every layer that is marked as used")
+	flag.BoolVar(&opts.quiet, "quiet", false, "Only print unreferenced layers and other leaks, and nothing at all on a clean system")
+	flag.BoolVar(&opts.strict, "strict", false, "Run additional consistency checks on the layerDB and abort on the first unreadable layerDB entry")
+	flag.BoolVar(&opts.deep, "deep", false, "Verify image config digests and hash the contents of unreferenced on-disk layers to find duplicates of referenced layers (slow)")
+	flag.BoolVar(&opts.untagged, "images-without-repo-tag", false, "List images that have no tag and are not part of an inheritance chain")
+	flag.BoolVar(&listChains, "list-chains", false, "List the resolved image inheritance chains and exit")
+	flag.BoolVar(&opts.failedImports, "failed-imports", false, "Group unreferenced layers that look like leftovers of an interrupted 'docker load'")
+	flag.DurationVar(&opts.minReferenceAge, "min-reference-age", 0, "Never remove on-disk layers with files modified more recently than this, e.g. 10m, nor the layerDB entries pointing to them (they may belong to an in-progress pull)")
+	flag.StringVar(&ignoreErrorsMatching, "ignore-errors-matching", "", "Regular expression of non-fatal errors that are known to be benign and should not be shown")
+	flag.IntVar(&opts.removeConcurrency, "remove-concurrency", 1, "Number of layers to remove in parallel")
+	flag.IntVar(&opts.concurrency, "concurrency", runtime.NumCPU(), "Number of layer folders to read in parallel")
+	flag.StringVar(&compareFolder, "compare", "", "Root of a second Docker runtime to compare the images and layers against, e.g. after a migration")
+	flag.BoolVar(&opts.skipInheritance, "skip-inheritance", false, "Don't resolve names of unnamed child images through the imagedb metadata. Faster on large stores, but -verbose will show fewer image names")
+	flag.BoolVar(&opts.noFollow, "no-follow", false, "Don't follow junctions and symbolic links in the raw layer folder. They still count as present layers, but are never reported or removed")
+	flag.Var(&opts.excludeImages, "exclude-image", "Don't take the layers of images whose name matches this pattern, e.g. 'test/*:*', as used. Can be repeated")
+	flag.IntVar(&opts.maxChainDepth, "max-chain-depth", leakcheck.DefaultMaxChainDepth, "Maximum number of images in an inheritance chain, longer chains abort the scan as corrupted (0 for no limit)")
+	flag.BoolVar(&opts.refCount, "refcount", false, "List every layer with the number of images using it, most shared first")
+	flag.BoolVar(&opts.dualReferences, "dual-references", false, "List on-disk layers that are referenced by both an image and a container")
+	flag.StringVar(&findLayer, "find-layer", "", "Show the images using a layer, given by diff, layerDB ID or cache-id, and exit")
+	flag.StringVar(&findImage, "find-image", "", "List the layers of an image, given by name or sha256, with their on-disk paths and exit")
+	flag.StringVar(&inspectImage, "inspect-image", "", "Show the layer tree of a single image, given by name or sha256, and exit")
+	flag.StringVar(&exitCodeMapping, "exit-code-map", "", "Override the exit code of outcomes, e.g. orphans=4,dangling=5")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "Together with -remove, only show which folders would be removed")
+	flag.DurationVar(&opts.olderThan, "older-than", 0, "Only report and remove unreferenced on-disk layers whose newest file is older than this, e.g. 72h")
+	flag.Var(&opts.minSize, "min-size", "Only report and remove unreferenced on-disk layers of at least this size, e.g. 100MB")
+	flag.StringVar(&opts.logFile, "log-file", "", "Append a JSON line for every removed layer to this file")
+	flag.StringVar(&opts.quarantine, "quarantine", "", "Together with -remove, move unreferenced layers into this folder instead of deleting them")
+	flag.StringVar(&opts.mapOut, "map-out", "", "Write the images using every layer as JSON to this file")
+	flag.StringVar(&opts.prometheus, "prometheus", "", "Write the findings as metrics in the Prometheus text format to this file, e.g. for the textfile collector of node_exporter")
+	flag.BoolVar(&opts.jsonSummary, "json-summary", false, "Only print a single line JSON summary of every root, with layer counts, reclaimable bytes and the scan duration")
+	flag.StringVar(&opts.format, "format", "text", "Output format, either text, json or csv")
+	flag.BoolVar(&opts.stats, "stats", false, "List the disk space used by every image, largest first")
+	flag.StringVar(&opts.statsShared, "stats-shared", "split", "How -stats attributes layers shared by several images, either split evenly between them or full for every image")
+	flag.BoolVar(&opts.timing, "timing", false, "Print the duration of every phase of the scan")
+	flag.BoolVar(&noColor, "no-color", false, "Don't color the output, even on a terminal. Setting NO_COLOR has the same effect")
+	flag.BoolVar(&outputCompress, "output-compress", false, "Gzip the report written by -format json or csv and -json-summary, e.g. to pipe it into a .json.gz file. Files of -map-out are also compressed if their name ends with .gz")
+	flag.BoolVar(&humanStderr, "human-stderr", false, "Together with -format json or csv, write the human readable report to stderr instead of discarding it")
+	flag.BoolVar(&compact, "compact", false, "Together with -format json, only write the counts and reclaimable bytes, not the lists of layers")
+	flag.BoolVar(&opts.jsonIncludeConfig, "json-include-config", false, "Together with -format json, include the OS, architecture and layer count of every image")
+	flag.BoolVar(&opts.jsonOrphanHashes, "json-orphan-hashes", false, "Together with -format json, include a fingerprint of every unreferenced layer that is the same on every host, the diff of layerDB entries and a hash of the files of on-disk layers (slow)")
+	flag.BoolVar(&eventLog, "eventlog", false, "Record a summary of every run and every failed removal in the Windows Application event log")
+	flag.StringVar(&serveAddr, "serve", "", "Serve the JSON result on /scan and Prometheus metrics on /metrics at this address, e.g. :8080, scanning on every request")
+	flag.IntVar(&threshold, "threshold", 0, "Only fail if more than this number of unreferenced layers and orphaned metadata entries are found in a root, fewer are still reported")
+	flag.BoolVar(&reportOnly, "report-only", false, "Always exit with 0 once the scan is done, even if leaks or invalid images were found")
+	flag.StringVar(&ignoreFile, "ignore-file", "", "File with layerDB IDs, on-disk layer names or diffs, one per line, that are never reported or removed")
+	flag.BoolVar(&allowRunning, "allow-running", false, "Allow -remove while the docker service is running")
+	flag.BoolVar(&opts.assumeYes, "yes", false, "Don't ask for confirmation before removing layers")
+	flag.BoolVar(&opts.assumeYes, "force", false, "Alias for -yes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodeHelp)
+	}
+	flag.Parse()
+	opts.verbose = opts.verbosity >= 1
+	// these modes inspect a single root and exit
+	singleRoot := compareFolder != "" || inspectImage != "" || listChains || findLayer != "" || findImage != ""
+	if exitCodeMapping != "" {
+		if err := parseExitCodeMap(exitCodeMapping); err != nil {
+			fail(err)
+		}
+	}
+	switch opts.format {
+	case "text":
+	case "json", "csv":
+		if singleRoot {
+			fail("Error: -format ", opts.format, " can't be combined with -compare, -inspect-image, -list-chains, -find-layer or -find-image")
+		}
+		output = ioutil.Discard
+		findingOutput = ioutil.Discard
+		errOutput = os.Stderr
+		if humanStderr {
+			output = os.Stderr
+			findingOutput = os.Stderr
+		}
+	default:
+		fail("Error: unknown -format ", opts.format)
+	}
+	if humanStderr && opts.format == "text" {
+		fail("Error: -human-stderr requires -format json or csv")
+	}
+	if outputCompress && opts.format == "text" && !opts.jsonSummary && opts.mapOut == "" {
+		fail("Error: -output-compress requires -format json or csv, -json-summary or -map-out")
+	}
+	if compact && opts.format != "json" {
+		fail("Error: -compact requires -format json")
+	}
+	if opts.jsonIncludeConfig && (opts.format != "json" || compact) {
+		fail("Error: -json-include-config requires -format json and can't be combined with -compact")
+	}
+	if opts.jsonOrphanHashes && (opts.format != "json" || compact) {
+		fail("Error: -json-orphan-hashes requires -format json and can't be combined with -compact")
+	}
+	if opts.jsonSummary {
+		if opts.format != "text" || singleRoot {
+			fail("Error: -json-summary can't be combined with -format json or csv, -compare, -inspect-image, -list-chains, -find-layer or -find-image")
+		}
+		output = ioutil.Discard
+		findingOutput = ioutil.Discard
+		errOutput = os.Stderr
+	}
+	if opts.verbose && opts.quiet {
+		fail("Error: -verbose and -quiet can't be used together")
+	}
+	if opts.quiet {
+		output = ioutil.Discard
+	}
+	if !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout) && enableColor() {
+		colored := colorWriter{w: os.Stdout}
+		for _, w := range []*io.Writer{&output, &findingOutput, &errOutput} {
+			if *w == io.Writer(os.Stdout) {
+				*w = colored
+			}
+		}
+	}
+	if opts.quarantine != "" {
+		if !opts.remove && !opts.removeDangling {
+			fail("Error: -quarantine requires -remove or -remove-dangling")
+		}
+		if err := os.MkdirAll(opts.quarantine, 0700); err != nil {
+			fail("Error: failed to create quarantine folder: ", err)
+		}
+	}
+	if threshold < 0 {
+		fail("Error: -threshold must not be negative")
+	}
+	// without the inheritance chains, the parents and children of tagged images look untagged
+	if opts.skipInheritance && (opts.removeDangling || opts.untagged) {
+		fail("Error: -skip-inheritance can't be combined with -remove-dangling or -images-without-repo-tag")
+	}
+	if reportOnly && (opts.remove || opts.removeDangling) {
+		fail("Error: -report-only can't be combined with -remove or -remove-dangling")
+	}
+	if serveAddr != "" && (opts.remove || opts.removeDangling || singleRoot) {
+		fail("Error: -serve can't be combined with -remove, -remove-dangling, -compare, -inspect-image, -list-chains, -find-layer or -find-image")
+	}
+	if (opts.remove || opts.removeDangling) && !opts.dryRun && !allowRunning {
+		running, err := dockerRunning()
+		if err != nil {
+			fail("Error: failed to query the state of the docker service: ", err, ", pass -allow-running to skip this check")
+		}
+		if running {
+			fail("Error: the docker service is running, stop it before removing layers or pass -allow-running")
+		}
+	}
+	if opts.statsShared != "split" && opts.statsShared != "full" {
+		fail("Error: -stats-shared must be either split or full")
+	}
+	if opts.removeConcurrency < 1 {
+		fail("Error: -remove-concurrency must be at least 1")
+	}
+	if opts.concurrency < 1 {
+		fail("Error: -concurrency must be at least 1")
+	}
+	if ignoreErrorsMatching != "" {
+		pattern, err := regexp.Compile(ignoreErrorsMatching)
+		if err != nil {
+			fail("Error: invalid -ignore-errors-matching expression: ", err)
+		}
+		ignoreErrorsPattern = pattern
+		showIgnoredErrors = opts.verbose
+	}
+	if ignoreFile != "" {
+		ignored, err := readIgnoreFile(ignoreFile)
+		if err != nil {
+			fail(err)
+		}
+		opts.ignored = ignored
+	}
+	if len(folders) == 0 {
+		folders = folderList{leakcheck.DefaultFolder()}
+	}
+	if len(folders) > 1 && singleRoot {
+		fail("Error: -compare, -inspect-image, -list-chains, -find-layer and -find-image only work with a single -folder")
+	}
+	for _, folder := range folders {
+		if !leakcheck.IsTarArchive(folder) {
+			continue
+		}
+		// the layers in an archive can only be listed, neither removed nor inspected in depth
+		if opts.remove || opts.removeDangling || opts.deep || opts.olderThan > 0 || opts.stats || singleRoot || serveAddr != "" {
+			fail("Error: a tar archive as -folder can't be combined with -remove, -remove-dangling, -deep, -older-than, -stats, -compare, -inspect-image, -list-chains, -find-layer, -find-image or -serve")
+		}
+	}
+
+	if singleRoot {
+		folder := folders[0]
+		found, err := leakcheck.FolderExists(folder)
+		if err != nil {
+			fail(err)
+		}
+		if !found {
+			fail("Error: folder does not exist")
+		}
+		scanner := leakcheck.NewScanner(opts.driver)
+		scanner.SkipInheritance = opts.skipInheritance
+		scanner.MaxChainDepth = opts.maxChainDepth
+		scanner.Log = nonFatalLog{}
+		scanner.Verbosity = opts.verbosity
+		rootFolders := scanner.Folders(folder)
+		if structureErrors := rootFolders.StructureErrors(); len(structureErrors) != 0 {
+			fail(strings.Join(structureErrors, "\n"))
+		}
+
+		if compareFolder != "" {
+			// Ctrl+C aborts the scans.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			different, err := compareRoots(ctx, folder, compareFolder, opts.driver)
+			stop()
+			if err != nil {
+				fail(err)
+			}
+			if different {
+				exitWith(outcomeOrphans)
+			}
+			fmt.Fprintln(output, "No differences found")
+			exitWith(outcomeClean)
+		}
+
+		if findLayer != "" {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			_, err := scanner.Scan(ctx, folder)
+			stop()
+			if err != nil {
+				fail(err)
+			}
+			printLayerUsers(scanner, findLayer)
+			exitWith(outcomeClean)
+		}
+
+		if err := scanner.LoadImageNames(rootFolders); err != nil {
+			fail(err)
+		}
+		if inspectImage != "" {
+			broken, err := printImageLayerTree(scanner, rootFolders, inspectImage)
+			if err != nil {
+				fail(err)
+			}
+			if broken {
+				exitWith(outcomeError)
+			}
+			exitWith(outcomeClean)
+		}
+		if findImage != "" {
+			broken, err := printImageLayers(scanner, rootFolders, findImage)
+			if err != nil {
+				fail(err)
+			}
+			if broken {
+				exitWith(outcomeError)
+			}
+			exitWith(outcomeClean)
+		}
+		printInheritanceChains(scanner)
+		exitWith(outcomeClean)
+	}
+
+	if serveAddr != "" {
+		opts.quiet = true
+		if err := serve(serveAddr, folders, opts); err != nil {
+			fail(err)
+		}
+	}
+
+	if eventLog {
+		logger, err := openEventLog()
+		if err != nil {
+			fail(err)
+		}
+		events = logger
+		releaseLocks = append(releaseLocks, func() { logger.Close() })
+	}
+	if (opts.remove || opts.removeDangling) && !opts.dryRun {
+		for _, folder := range folders {
+			release, err := lockRoot(folder)
+			if err != nil {
+				fail(err)
+			}
+			releaseLocks = append(releaseLocks, release)
+		}
+	}
+
+	var reports []rootReport
+	for _, folder := range folders {
+		label := ""
+		if len(folders) > 1 {
+			label = "[" + folder + "] "
+			fmt.Fprintln(output, "Info: Checking", folder)
+		}
+		report := checkRoot(folder, label, opts)
+		if report.err != nil {
+			fmt.Fprintln(errOutput, label+report.err.Error())
+			if errors.Is(report.err, context.Canceled) {
+				exitWith(outcomeError)
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	if len(reports) > 1 {
+		printRootSummary(reports)
+	}
+	if ignoredErrorCount != 0 {
+		fmt.Fprintf(output, "Info: Ignored %d errors matching %s\n", ignoredErrorCount, ignoreErrorsPattern)
+	}
+	if opts.mapOut != "" {
+		if err := writeLayerMap(opts.mapOut, reports, outputCompress || strings.HasSuffix(opts.mapOut, ".gz")); err != nil {
+			fail(err)
+		}
+	}
+	if opts.prometheus != "" {
+		if err := writePrometheusMetrics(opts.prometheus, reports); err != nil {
+			fail(err)
+		}
+	}
+	// the report on stdout is compressed as a whole, so it can be piped into a single .gz file
+	reportOutput, closeReport := compressedWriter(os.Stdout, outputCompress && (opts.jsonSummary || opts.format != "text"))
+	if opts.jsonSummary {
+		for _, report := range reports {
+			if err := writeJSONSummary(reportOutput, report); err != nil {
+				fail(err)
+			}
+		}
+	}
+	if opts.format == "csv" {
+		if err := writeCSVResult(reportOutput, reports); err != nil {
+			fail(err)
+		}
+	}
+	if opts.format == "json" {
+		var results []interface{}
+		for _, report := range reports {
+			if report.err != nil {
+				continue
+			}
+			result := newScanResult(report.folder, report.result.UnreferencedLayers, report.result.UnreferencedRawLayers, report.reclaimable)
+			result.Images = report.images
+			result.UnreferencedLayerHashes = report.layerHashes
+			result.UnreferencedRawLayerHashes = report.rawLayerHashes
+			if compact {
+				results = append(results, result.compact())
+			} else {
+				results = append(results, result)
+			}
+		}
+		var err error
+		if len(folders) == 1 && len(results) == 1 {
+			err = writeJSONResult(reportOutput, results[0])
+		} else if len(folders) > 1 {
+			err = writeJSONResult(reportOutput, results)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	if err := closeReport(); err != nil {
+		fail(err)
+	}
+
+	// The worst outcome of all roots determines the exit code.
+	outcome := outcomeClean
+	tolerated := 0
+	for _, report := range reports {
+		o := report.outcome()
+		if o == outcomeOrphans && report.leakCount() <= threshold {
+			o = outcomeClean
+			tolerated += report.leakCount()
+		}
+		if outcomeSeverity[o] > outcomeSeverity[outcome] {
+			outcome = o
+		}
+	}
+	if (outcome == outcomeClean || outcome == outcomeDangling) && tolerated != 0 {
+		fmt.Fprintf(output, "Info: Found %d leaks, not more than -threshold %d per root\n", tolerated, threshold)
+	} else if outcome == outcomeClean || outcome == outcomeDangling {
+		fmt.Fprintln(output, "No errors found")
+	}
+	if events != nil {
+		if err := events.Info(eventRunSummary, runSummary(reports, outcome)); err != nil {
+			printNonFatal("WARN: Failed to write to the event log: ", err)
+		}
+	}
+	// only a completed scan of every root is reported as success
+	completed := true
+	for _, report := range reports {
+		completed = completed && report.err == nil
+	}
+	if reportOnly && completed {
+		exit(0)
+	}
+	exitWith(outcome)
+}
+
+// outcomeSeverity orders the outcomes, so the worst outcome of several roots can be picked.
+var outcomeSeverity = map[string]int{
+	outcomeClean:    0,
+	outcomeDangling: 1,
+	outcomeOrphans:  2,
+	outcomePartial:  3,
+	outcomeError:    4,
+}
+
+// rootReport is the outcome of checking a single Docker runtime root.
+type rootReport struct {
+	folder string
+	result leakcheck.Result
+	// Size of the unreferenced on-disk layers.
+	reclaimable int64
+	// Bytes freed by removing layers.
+	freed    int64
+	duration time.Duration
+	// Names of the images using every layer, only collected for -map-out.
+	layerImages map[string][]string
+	// Config summaries of all images, only collected for -json-include-config.
+	images []imageConfig
+	// Fingerprints of the unreferenced layerDB entries and on-disk layers, only collected for -json-orphan-hashes.
+	layerHashes    map[string]string
+	rawLayerHashes map[string]string
+	// One row per unreferenced layer, only collected for -format csv.
+	csvRows [][]string
+	// Invalid images or incomplete layers were found.
+	invalid       bool
+	removalFailed bool
+	// The root could not be scanned at all.
+	err error
+}
+
+// leakCount is the number of unreferenced layers and orphaned metadata entries, as compared against -threshold.
+func (r rootReport) leakCount() int {
+	return len(r.result.UnreferencedLayers) + len(r.result.UnreferencedRawLayers) + len(r.result.OrphanedMetadata)
+}
+
+func (r rootReport) outcome() string {
+	switch {
+	case r.err != nil || r.invalid:
+		return outcomeError
+	case r.removalFailed:
+		return outcomePartial
+	case r.leakCount() != 0:
+		return outcomeOrphans
+	case len(r.result.DanglingImages) != 0:
+		return outcomeDangling
+	}
+	return outcomeClean
+}
+
+// eventLogger records the outcome of a run in a system log, see -eventlog.
+type eventLogger interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Close() error
+}
+
+// Event IDs written to the event log.
+const (
+	eventRunSummary    = 1
+	eventRemovalFailed = 2
+)
+
+// events is set by -eventlog.
+var events eventLogger
+
+// runSummary describes the findings and removals of all roots in a single message.
+func runSummary(reports []rootReport, outcome string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "docker-leak-check finished with outcome %s.", outcome)
+	for _, r := range reports {
+		if r.err != nil {
+			fmt.Fprintf(&b, "\n%s: failed to scan: %v", r.folder, r.err)
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s: %d unreferenced layerDB entries, %d unreferenced on-disk layers, %d bytes reclaimable, %d bytes freed",
+			r.folder, len(r.result.UnreferencedLayers), len(r.result.UnreferencedRawLayers), r.reclaimable, r.freed)
+	}
+	return b.String()
+}
+
+// printRootSummary prints the findings of every root, followed by the totals of all roots.
+func printRootSummary(reports []rootReport) {
+	var layers, rawLayers int
+	var reclaimable int64
+	for _, r := range reports {
+		if r.err != nil {
+			fmt.Fprintf(output, "Info: %s: failed to scan\n", r.folder)
+			continue
+		}
+		fmt.Fprintf(output, "Info: %s: %d unreferenced layerDB entries, %d unreferenced on-disk layers, %s reclaimable\n",
+			r.folder, len(r.result.UnreferencedLayers), len(r.result.UnreferencedRawLayers), humanSize(r.reclaimable))
+		layers += len(r.result.UnreferencedLayers)
+		rawLayers += len(r.result.UnreferencedRawLayers)
+		reclaimable += r.reclaimable
+	}
+	fmt.Fprintf(output, "Info: Total: %d unreferenced layerDB entries, %d unreferenced on-disk layers, %s reclaimable\n",
+		layers, rawLayers, humanSize(reclaimable))
+}
+
+// readIgnoreFile reads the layers to ignore, one per line. Empty lines and lines starting with # are skipped.
+func readIgnoreFile(path string) (map[string]struct{}, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read ignore file: %v", err)
+	}
+	ignored := make(map[string]struct{})
+	for _, line := range strings.Split(string(dat), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignored[strings.TrimPrefix(line, "sha256:")] = struct{}{}
+	}
+	return ignored, nil
+}
+
+// filterIgnored returns the layers that are not in the ignore list, and writes every ignored one to w. kind describes
+// the layers in the output, e.g. "unreferenced layer in layerDB". If given, diffOf returns the diff of a layer, so
+// layers can be ignored by their diff as well.
+func filterIgnored(w io.Writer, layers []string, label, kind string, ignored map[string]struct{}, diffOf func(layer string) string) []string {
+	var kept []string
+	for _, layer := range layers {
+		_, found := ignored[layer]
+		if !found && diffOf != nil {
+			_, found = ignored[strings.TrimPrefix(diffOf(layer), "sha256:")]
+		}
+		if found {
+			fmt.Fprintln(w, label+"Info: Ignored "+kind+": ", layer)
+			continue
+		}
+		kept = append(kept, layer)
+	}
+	return kept
+}
+
+// newScanner creates a scanner configured by the command line options.
+func newScanner(opts options) *leakcheck.Scanner {
+	scanner := leakcheck.NewScanner(opts.driver)
+	scanner.Strict = opts.strict
+	scanner.SkipInheritance = opts.skipInheritance
+	scanner.MaxChainDepth = opts.maxChainDepth
+	scanner.ExcludeImages = opts.excludeImages
+	scanner.NoFollow = opts.noFollow
+	scanner.Concurrency = opts.concurrency
+	scanner.Log = nonFatalLog{}
+	scanner.Verbosity = opts.verbosity
+	if !opts.quiet {
+		scanner.Progress = newProgressReporter(os.Stderr, 2*time.Second).report
+	}
+	return scanner
+}
+
+// applyIgnoreList removes the entries in the ignore list from every kind of finding of a scan, so they are neither
+// reported nor removed. The ignored entries are written to w.
+func applyIgnoreList(w io.Writer, scanner *leakcheck.Scanner, folders leakcheck.Folders, label string, result leakcheck.Result, ignored map[string]struct{}) leakcheck.Result {
+	driver := folders.Driver
+	result.UnreferencedLayers = filterIgnored(w, result.UnreferencedLayers, label, "unreferenced layer in layerDB", ignored, func(layer string) string {
+		dat, err := scanner.FS.ReadFile(filepath.Join(folders.LayerDB, layer, "diff"))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(dat))
+	})
+	result.UnreferencedRawLayers = filterIgnored(w, result.UnreferencedRawLayers, label, "unreferenced layer in "+driver, ignored, nil)
+	result.PartialRawLayers = filterIgnored(w, result.PartialRawLayers, label, "partial download in "+driver, ignored, nil)
+	result.SandboxRawLayers = filterIgnored(w, result.SandboxRawLayers, label, "unreferenced sandbox in "+driver, ignored, nil)
+	result.TempRawLayers = filterIgnored(w, result.TempRawLayers, label, "temporary folder in "+driver, ignored, nil)
+	result.OrphanedMetadata = filterIgnored(w, result.OrphanedMetadata, label, "orphaned imagedb metadata", ignored, nil)
+	return result
+}
+
+// filterBySize measures the unreferenced raw layers and returns the ones of at least minSize along with their total
+// size, and the number and total size of the smaller ones. each is called with every layer that is kept.
+func filterBySize(rawLayerFolder string, layers []string, minSize int64, each func(layer string, size int64)) (large []string, reclaimable int64, smallCount int, smallTotal int64) {
+	for _, layer := range layers {
+		size, skipped := leakcheck.LayerSize(filepath.Join(rawLayerFolder, layer))
+		for _, path := range skipped {
+			printNonFatal("WARN: Could not determine size of ", path)
+		}
+		if size < minSize {
+			smallCount++
+			smallTotal += size
+			continue
+		}
+		large = append(large, layer)
+		reclaimable += size
+		if each != nil {
+			each(layer, size)
+		}
+	}
+	return large, reclaimable, smallCount, smallTotal
+}
+
+// checkRoot scans a single Docker runtime root, prints its findings and removes the unreferenced layers if requested.
+// Findings are prefixed with the label, so they can be told apart when checking several roots.
+func checkRoot(folder, label string, opts options) rootReport {
+	report := rootReport{folder: folder}
+	driver := opts.driver
+	scanner := newScanner(opts)
+	archive := leakcheck.IsTarArchive(folder)
+	if archive {
+		tarFS, err := leakcheck.NewTarFileSystem(folder)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		scanner.FS = tarFS
+	}
+	folders := scanner.Folders(folder)
+	imageDBFolder := folders.ImageDB
+	layerDBFolder := folders.LayerDB
+	rawLayerFolder := folders.RawLayer
+
+	// Ctrl+C aborts the scan. Once the scan is done, the handler is removed again, so it behaves as usual from then on.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	start := time.Now()
+	result, err := scanner.Scan(ctx, folder)
+	report.duration = time.Since(start)
+	stop()
+	if err != nil {
+		report.err = err
+		return report
+	}
+	if len(opts.ignored) != 0 {
+		result = applyIgnoreList(output, scanner, folders, label, result, opts.ignored)
+	}
+	report.result = result
+	unreferencedLayers := result.UnreferencedLayers
+	unreferencedRawLayers := result.UnreferencedRawLayers
+
+	if opts.verbose {
+		printLayerImages(scanner.LayerImages())
+	}
+	if opts.mapOut != "" {
+		report.layerImages = scanner.LayerImages()
+	}
+	if opts.refCount {
+		printLayerRefCounts(scanner.LayerImages())
+	}
+	if opts.stats {
+		printImageStats(scanner, rawLayerFolder, opts.statsShared == "split")
+	}
+
+	if opts.untagged {
+		images, err := scanner.UntaggedImages(imageDBFolder)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		for _, sha := range images {
+			fmt.Fprintln(output, label+"Info: Image without repository tag: ", sha)
+		}
+	}
+
+	printDanglingChains(result, opts.verbose)
+
+	for _, skipped := range result.SkippedRawLayers {
+		printNonFatal(label+"WARN: Skipped layer in "+driver+": ", skipped)
+	}
+
+	staleTags := make([]string, 0, len(result.StaleTags))
+	for tag := range result.StaleTags {
+		staleTags = append(staleTags, tag)
+	}
+	sort.Strings(staleTags)
+	for _, tag := range staleTags {
+		printNonFatal(label+"WARN: Repository tag ", tag, " points to missing image: ", result.StaleTags[tag])
+	}
+
+	unreadable := make([]string, 0, len(result.UnreadableLayers))
+	for layer := range result.UnreadableLayers {
+		unreadable = append(unreadable, layer)
+	}
+	sort.Strings(unreadable)
+	for _, layer := range unreadable {
+		printNonFatal(label+"WARN: Skipped unreadable layerDB entry ", layer, ": ", result.UnreadableLayers[layer])
+	}
+
+	missing := make([]string, 0, len(result.MissingRawLayers))
+	for layer := range result.MissingRawLayers {
+		missing = append(missing, layer)
+	}
+	sort.Strings(missing)
+	for _, layer := range missing {
+		fmt.Fprintln(output, label+"Error: LayerDB entry ", layer, " points to missing layer in "+driver+": ", result.MissingRawLayers[layer])
+	}
+
+	for _, layer := range result.SandboxRawLayers {
+		fmt.Fprintln(output, label+"Info: Unreferenced sandbox in "+driver+": ", layer)
+	}
+	for _, layer := range result.TempRawLayers {
+		fmt.Fprintln(output, label+"Info: Temporary folder in "+driver+": ", layer)
+	}
+
+	for _, layer := range result.PinnedLayers {
+		fmt.Fprintln(output, label+"Info: Former image layer pinned by container: ", layer)
+	}
+
+	if opts.dualReferences {
+		for _, layer := range result.DualReferencedLayers {
+			fmt.Fprintln(output, label+"Info: Layer in "+driver+" referenced by both an image and a container: ", layer)
+		}
+	}
+
+	if opts.failedImports {
+		clusters, err := scanner.FindFailedImports(layerDBFolder, unreferencedLayers, unreferencedRawLayers)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		for _, c := range clusters {
+			fmt.Fprintf(output, label+"Info: Likely failed import of %d layers (created between %s and %s):\n",
+				len(c.Layers), c.Oldest.Format(time.RFC3339), c.Newest.Format(time.RFC3339))
+			for _, layer := range c.Layers {
+				fmt.Fprintln(output, "\t", layer)
+			}
+		}
+	}
+
+	if opts.deep {
+		corrupt, err := scanner.VerifyImageDigests(imageDBFolder)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		for _, msg := range corrupt {
+			fmt.Fprintln(output, label+"Error: ", msg)
+		}
+		if len(corrupt) != 0 {
+			report.invalid = true
+		}
+
+		duplicates, err := scanner.FindDuplicateLayers(rawLayerFolder, unreferencedRawLayers)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		for _, layer := range unreferencedRawLayers {
+			if original, found := duplicates[layer]; found {
+				fmt.Fprintln(output, label+"Info: Unreferenced layer in "+driver+": ", layer, " is a duplicate of referenced layer ", original)
+			}
+		}
+	}
+
+	if opts.olderThan > 0 && len(unreferencedRawLayers) != 0 {
+		var old []string
+		recentCount := 0
+		for _, layer := range unreferencedRawLayers {
+			newest, err := leakcheck.NewestModTime(filepath.Join(rawLayerFolder, layer))
+			if err != nil {
+				// rather keep a layer than remove one that may still be in use
+				printNonFatal(label + err.Error())
+				recentCount++
+				continue
+			}
+			if time.Since(newest) < opts.olderThan {
+				recentCount++
+				continue
+			}
+			old = append(old, layer)
+		}
+		if recentCount != 0 {
+			fmt.Fprintf(output, label+"Info: Ignored %d unreferenced layers in %s modified within the last %v\n", recentCount, driver, opts.olderThan)
+		}
+		unreferencedRawLayers = old
+		report.result.UnreferencedRawLayers = old
+	}
+
+	// the sizes of the layers in an archive are unknown, since only their metadata is read
+	if len(unreferencedRawLayers) != 0 && !archive {
+		large, reclaimable, smallCount, smallTotal := filterBySize(rawLayerFolder, unreferencedRawLayers, int64(opts.minSize), func(layer string, size int64) {
+			fmt.Fprintln(output, label+"Info: Reclaimable space of layer in "+driver+": ", layer, ": ", humanSize(size))
+		})
+		report.reclaimable = reclaimable
+		fmt.Fprintf(output, label+"Info: Total reclaimable space: %s in %d layers\n", humanSize(report.reclaimable), len(large))
+		if smallCount != 0 {
+			fmt.Fprintf(output, label+"Info: Ignored %d unreferenced layers in %s below -min-size, %s in total\n", smallCount, driver, humanSize(smallTotal))
+		}
+		unreferencedRawLayers = large
+		report.result.UnreferencedRawLayers = large
+	}
+
+	if opts.removeDangling {
+		images, err := scanner.RemovableImages(folders)
+		if err != nil {
+			report.err = err
+			return report
+		}
+		images = filterIgnored(output, images, label, "dangling image", opts.ignored, nil)
+		var removals []removal
+		for _, sha := range images {
+			fmt.Fprintln(output, label+"Info: Dangling image: ", sha)
+			removals = append(removals, removal{folder: imageDBFolder, layer: sha, kind: "imagedb content", metadata: true})
+			if found, _ := leakcheck.FolderExists(filepath.Join(folders.ImageMetaData, sha)); found {
+				removals = append(removals, removal{folder: folders.ImageMetaData, layer: sha, kind: "imagedb metadata", metadata: true})
+			}
+		}
+		failed, freed := runRemovals(removals, opts, nil)
+		report.removalFailed = report.removalFailed || failed
+		report.freed += freed
+		if len(images) != 0 && !opts.dryRun {
+			fmt.Fprintln(output, label+"Info: Run again to find the layers that were only used by the removed images")
+		}
+	}
+
+	if len(unreferencedLayers) != 0 || len(unreferencedRawLayers) != 0 || len(result.OrphanedMetadata) != 0 || len(result.PartialRawLayers) != 0 {
+		var removals []removal
+		for _, sha := range result.OrphanedMetadata {
+			if opts.remove {
+				removals = append(removals, removal{folder: folders.ImageMetaData, layer: sha, kind: "imagedb metadata", metadata: true})
+			} else {
+				fmt.Fprintln(findingOutput, label+"Error: Orphaned imagedb metadata: ", sha)
+			}
+		}
+		for _, layer := range unreferencedLayers {
+			if opts.remove && recentLayerDBEntry(scanner.FS, layerDBFolder, rawLayerFolder, layer, opts.minReferenceAge) {
+				continue
+			}
+			if opts.remove {
+				removals = append(removals, removal{folder: layerDBFolder, layer: layer, kind: "layerDB"})
+			} else {
+				fmt.Fprintln(findingOutput, label+"Error: Unreferenced layer in layerDB: ", layer)
+			}
+		}
+
+		for _, layer := range unreferencedRawLayers {
+			if opts.remove && modifiedRecently(rawLayerFolder, layer, driver, opts.minReferenceAge) {
+				continue
+			}
+			if opts.remove {
+				removals = append(removals, removal{folder: rawLayerFolder, layer: layer, kind: driver})
+			} else {
+				fmt.Fprintln(findingOutput, label+"Error: Unreferenced layer in "+driver+": ", layer)
+			}
+		}
+		// partial downloads are never used, but may belong to a pull that is still in progress
+		for _, layer := range result.PartialRawLayers {
+			if opts.remove && !modifiedRecently(rawLayerFolder, layer, "partial download", opts.minReferenceAge) {
+				removals = append(removals, removal{folder: rawLayerFolder, layer: layer, kind: "partial download"})
+			} else if !opts.remove {
+				fmt.Fprintln(output, label+"Info: Partial download in "+driver+": ", layer)
+			}
+		}
+		failed, freed := runRemovals(removals, opts, func(removals []removal) ([]removal, error) {
+			return preflightRemovals(folder, removals, opts)
+		})
+		report.removalFailed = report.removalFailed || failed
+		report.freed += freed
+	}
+	if len(result.InconsistentImages) != 0 || len(result.IncompleteLayers) != 0 || len(result.MissingRawLayers) != 0 || len(result.UnreadableLayers) != 0 {
+		report.invalid = true
+	}
+	if opts.format == "csv" {
+		report.csvRows = csvRows(scanner, folders, report)
+	}
+	if opts.jsonIncludeConfig {
+		report.images = imageConfigs(scanner)
+	}
+	if opts.jsonOrphanHashes {
+		report.layerHashes, report.rawLayerHashes = orphanHashes(scanner, folders, report.result, archive)
+	}
+	fmt.Fprintf(output, label+"Info: Scanned %d images, %d layerDB entries, %d raw layers in layout image/%s; found %d unreferenced layerDB and %d unreferenced raw layers\n",
+		result.ImageCount, result.LayerCount, result.RawLayerCount, folders.Layout, len(report.result.UnreferencedLayers), len(report.result.UnreferencedRawLayers))
+	if opts.timing {
+		printTiming(os.Stderr, result.Phases, report.duration)
+	}
+	return report
+}
+
+// printTiming prints a table of the durations of the scan phases, followed by the duration of the whole scan.
+func printTiming(w io.Writer, phases []leakcheck.Phase, total time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Phase\tDuration")
+	for _, phase := range phases {
+		fmt.Fprintf(tw, "%s\t%v\n", phase.Name, phase.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "Total scan\t%v\n", total.Round(time.Millisecond))
+	tw.Flush()
+}
+
+// modifiedRecently reports whether a layer was modified within the given window and must not be removed yet. Layers
+// whose age can't be determined are kept as well.
+func modifiedRecently(folder, layer, kind string, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	recent, err := modifiedWithin(filepath.Join(folder, layer), window)
+	if err != nil {
+		printNonFatal(err)
+		return true
+	}
+	if recent {
+		fmt.Fprintln(output, "Info: Unreferenced layer in "+kind+": ", layer, " was modified recently, skipping...")
+	}
+	return recent
+}
+
+// recentLayerDBEntry reports whether the on-disk layer a layerDB entry points to was modified within the given window.
+// The entry then likely belongs to the same pull in progress as the layer.
+func recentLayerDBEntry(fsys leakcheck.FileSystem, layerDBFolder, rawLayerFolder, layer string, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	dat, err := fsys.ReadFile(filepath.Join(layerDBFolder, layer, "cache-id"))
+	if err != nil {
+		return false
+	}
+	cacheID := strings.TrimSpace(string(dat))
+	if found, _ := leakcheck.FolderExists(filepath.Join(rawLayerFolder, cacheID)); cacheID == "" || !found {
+		return false
+	}
+	recent, err := modifiedWithin(filepath.Join(rawLayerFolder, cacheID), window)
+	if err != nil {
+		printNonFatal(err)
+		return true
+	}
+	if recent {
+		fmt.Fprintln(output, "Info: Unreferenced layer in layerDB: ", layer, " points to recently modified layer ", cacheID, ", skipping...")
+	}
+	return recent
+}
+
+// runRemovals asks for confirmation, unless -yes or -dry-run are given, and then removes the given entries. It reports
+// whether any of the removals failed and how many bytes were freed.
+func runRemovals(removals []removal, opts options, preflight func([]removal) ([]removal, error)) (bool, int64) {
+	if len(removals) == 0 {
+		return false, 0
+	}
+	estimate := estimateRemovals(removals)
+	fmt.Fprintf(output, "Info: Removing %d entries will free about %s\n", len(removals), humanSize(estimate))
+	if !opts.dryRun && !opts.assumeYes {
+		confirmed, err := confirmRemoval(removals, estimate)
+		if err != nil {
+			fail(err)
+		}
+		if !confirmed {
+			fail("Aborted, nothing was removed")
+		}
+	}
+	// the state may have changed since the scan, e.g. while waiting for the confirmation
+	if preflight != nil && !opts.dryRun {
+		verified, err := preflight(removals)
+		if err != nil {
+			fail(err)
+		}
+		if len(verified) != len(removals) {
+			removals = verified
+			estimate = estimateRemovals(removals)
+		}
+		if len(removals) == 0 {
+			return false, 0
+		}
+	}
+	removeOpts := removeOptions{concurrency: opts.removeConcurrency, dryRun: opts.dryRun, quarantine: opts.quarantine}
+	if opts.logFile != "" && !opts.dryRun {
+		f, err := os.OpenFile(opts.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fail("Error: failed to open log file: ", err)
+		}
+		defer f.Close()
+		removeOpts.audit = &auditLog{w: f}
+	}
+	failures, freed := removeLayers(removals, removeOpts)
+	if !opts.dryRun {
+		printRemovalSummary(removals, failures, freed, estimate)
+	}
+	if events != nil {
+		for _, f := range failures {
+			if err := events.Warning(eventRemovalFailed, fmt.Sprintf("Failed to remove %s: %v", filepath.Join(f.folder, f.layer), f.err)); err != nil {
+				printNonFatal("WARN: Failed to write to the event log: ", err)
+			}
+		}
+	}
+	return len(failures) != 0, freed
+}
+
+// preflightRemovals scans the root again right before removing anything and drops the layers that are no longer
+// unreferenced, e.g. because an image was pulled or a container was started since the first scan. Metadata entries
+// are passed through.
+func preflightRemovals(folder string, removals []removal, opts options) ([]removal, error) {
+	scanner := newScanner(opts)
+	result, err := scanner.Scan(context.Background(), folder)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced := map[string]map[string]struct{}{
+		"layerDB":          toSet(result.UnreferencedLayers),
+		opts.driver:        toSet(result.UnreferencedRawLayers),
+		"partial download": toSet(result.PartialRawLayers),
+	}
+	var verified []removal
+	skipped := 0
+	for _, r := range removals {
+		if current, checked := unreferenced[r.kind]; checked && !r.metadata {
+			if _, found := current[r.layer]; !found {
+				fmt.Fprintln(output, "Info: Not removing layer in "+r.kind+" that became referenced since the scan: ", r.layer)
+				skipped++
+				continue
+			}
+		}
+		verified = append(verified, r)
+	}
+	if skipped != 0 {
+		fmt.Fprintf(output, "Info: Skipped %d entries that became referenced since the scan\n", skipped)
+	}
+	return verified, nil
+}
 
-package main
+// progressReporter prints the progress of a scan, at most once per interval. Scans that finish within the first
+// interval don't print anything.
+type progressReporter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	interval time.Duration
+	last     time.Time
+}
 
-import (
-	"encoding/json"
-	"flag"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
-)
+func newProgressReporter(w io.Writer, interval time.Duration) *progressReporter {
+	return &progressReporter{w: w, interval: interval, last: time.Now()}
+}
 
-// Reverse lookup of image sha sums to names. For logging purposes.
-var imageNameDB = make(map[shaSum]string)
+func (p *progressReporter) report(stage string, done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.last) < p.interval {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(p.w, "Info: Scanned %d/%d %s\n", done, total, stage)
+}
 
-// Map of layers to image names. Unfortunately, Go doesn't have sets, hence we must use a map for the values.
-var layerImageDB = make(map[shaSum]map[string]struct{})
+// printNonFatal prints an error that does not abort the run, unless it matches the -ignore-errors-matching pattern.
+func printNonFatal(a ...interface{}) {
+	writeNonFatal(fmt.Sprintln(a...))
+}
 
-type shaSum string
+// nonFatalLog passes the warnings of the scanner through the same filter as printNonFatal.
+type nonFatalLog struct{}
 
-type imageType struct {
-	RootFS *rootFS `json:"rootfs,omitempty"`
-	OS     string  `json:"os,omitempty"`
+func (nonFatalLog) Write(p []byte) (int, error) {
+	writeNonFatal(string(p))
+	return len(p), nil
 }
 
-type rootFS struct {
-	Type    string   `json:"type"`
-	DiffIDs []string `json:"diff_ids,omitempty"`
+func writeNonFatal(msg string) {
+	if ignoreErrorsPattern != nil && ignoreErrorsPattern.MatchString(msg) {
+		ignoredErrorMu.Lock()
+		ignoredErrorCount++
+		ignoredErrorMu.Unlock()
+		if showIgnoredErrors {
+			fmt.Fprint(output, "Debug: ", msg)
+		}
+		return
+	}
+	fmt.Fprint(output, msg)
 }
 
-type layerDBItem struct {
-	ID      string
-	diff    string
-	cacheID string
-	visited bool
+// scanResult is the machine readable result of a scan.
+type scanResult struct {
+	Folder                    string   `json:"folder"`
+	UnreferencedLayers        []string `json:"unreferencedLayers"`
+	UnreferencedRawLayers     []string `json:"unreferencedRawLayers"`
+	UnreferencedLayerCount    int      `json:"unreferencedLayerCount"`
+	UnreferencedRawLayerCount int      `json:"unreferencedRawLayerCount"`
+	ReclaimableBytes          int64    `json:"reclaimableBytes"`
+	// Images is only set for -json-include-config.
+	Images []imageConfig `json:"images,omitempty"`
+	// The fingerprints of the unreferenced layers are only set for -json-orphan-hashes.
+	UnreferencedLayerHashes    map[string]string `json:"unreferencedLayerHashes,omitempty"`
+	UnreferencedRawLayerHashes map[string]string `json:"unreferencedRawLayerHashes,omitempty"`
+	// Error is set if the root could not be scanned, only used by -serve.
+	Error string `json:"error,omitempty"`
 }
 
-type rawLayerType struct {
-	ID      string
-	visited bool
+// imageConfig is the config summary of an image written by -json-include-config.
+type imageConfig struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	OS           string `json:"os"`
+	Architecture string `json:"architecture,omitempty"`
+	LayerCount   int    `json:"layerCount"`
 }
 
-func folderExists(path string) bool {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true
+// imageConfigs returns the config summaries of all images of the last scan, sorted by ID.
+func imageConfigs(scanner *leakcheck.Scanner) []imageConfig {
+	configs := scanner.ImageConfigs()
+	images := make([]imageConfig, 0, len(configs))
+	for id, config := range configs {
+		images = append(images, imageConfig{ID: id, Name: config.Name, OS: config.OS, Architecture: config.Architecture, LayerCount: config.LayerCount})
 	}
-	if os.IsNotExist(err) {
-		return false
-	}
-	return true
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images
 }
 
-func main() {
-	var folder string
-	var remove bool
-	var verbose bool
-	flag.StringVar(&folder, "folder", "", "Root of the Docker runtime (default \"C:\\ProgramData\\docker\")")
-	flag.BoolVar(&remove, "remove", false, "Remove unreferenced layers")
-	flag.BoolVar(&verbose, "verbose", false, "Display extra info on valid layers")
-	flag.Parse()
-	if folder == "" {
-		folder = `C:\programdata\docker`
+// orphanHashes returns fingerprints of the unreferenced layers that don't depend on the host, so the same leak can be
+// recognized across hosts. LayerDB entries are identified by their diff, on-disk layers by a hash of their files. The
+// files of the layers in an archive are not available, so only the layerDB entries are fingerprinted for archives.
+func orphanHashes(scanner *leakcheck.Scanner, folders leakcheck.Folders, result leakcheck.Result, archive bool) (map[string]string, map[string]string) {
+	layerHashes := make(map[string]string, len(result.UnreferencedLayers))
+	for _, layer := range result.UnreferencedLayers {
+		dat, err := scanner.FS.ReadFile(filepath.Join(folders.LayerDB, layer, "diff"))
+		if err != nil {
+			printNonFatal("WARN: Could not fingerprint layerDB entry ", layer, ": ", err)
+			continue
+		}
+		layerHashes[layer] = strings.TrimSpace(string(dat))
 	}
-	if !folderExists(folder) {
-		fmt.Println("Error: folder does not exist")
-		os.Exit(-1)
+	if archive {
+		return layerHashes, nil
 	}
-
-	imageDBFolder := filepath.Join(folder, "image", "windowsfilter", "imagedb", "content", "sha256")
-	if !folderExists(imageDBFolder) {
-		fmt.Printf("Error: incorrect folder structure: expected %s to exist\n", imageDBFolder)
-		os.Exit(-1)
+	rawLayerHashes := make(map[string]string, len(result.UnreferencedRawLayers))
+	for _, layer := range result.UnreferencedRawLayers {
+		hash, err := leakcheck.HashLayer(filepath.Join(folders.RawLayer, layer))
+		if err != nil {
+			printNonFatal("WARN: Could not fingerprint layer in "+folders.Driver+" ", layer, ": ", err)
+			continue
+		}
+		rawLayerHashes[layer] = "sha256:" + hash
 	}
+	return layerHashes, rawLayerHashes
+}
+
+// compactScanResult is a scanResult without the lists of layers, written by -compact.
+type compactScanResult struct {
+	Folder                    string `json:"folder"`
+	UnreferencedLayerCount    int    `json:"unreferencedLayerCount"`
+	UnreferencedRawLayerCount int    `json:"unreferencedRawLayerCount"`
+	ReclaimableBytes          int64  `json:"reclaimableBytes"`
+}
 
-	layerDBFolder := filepath.Join(folder, "image", "windowsfilter", "layerdb", "sha256")
-	if !folderExists(layerDBFolder) {
-		fmt.Printf("Error: incorrect folder structure: expected %s to exist\n", layerDBFolder)
-		os.Exit(-1)
+func newScanResult(folder string, unreferencedLayers, unreferencedRawLayers []string, reclaimable int64) scanResult {
+	result := scanResult{
+		Folder:                    folder,
+		UnreferencedLayers:        append([]string{}, unreferencedLayers...),
+		UnreferencedRawLayers:     append([]string{}, unreferencedRawLayers...),
+		UnreferencedLayerCount:    len(unreferencedLayers),
+		UnreferencedRawLayerCount: len(unreferencedRawLayers),
+		ReclaimableBytes:          reclaimable,
 	}
-	rawLayerFolder := filepath.Join(folder, "windowsfilter")
-	if !folderExists(rawLayerFolder) {
-		fmt.Printf("Error: incorrect folder structure: expected %s to exist\n", rawLayerFolder)
-		os.Exit(-1)
+	sort.Strings(result.UnreferencedLayers)
+	sort.Strings(result.UnreferencedRawLayers)
+	return result
+}
+
+func (r scanResult) compact() compactScanResult {
+	return compactScanResult{
+		Folder:                    r.Folder,
+		UnreferencedLayerCount:    r.UnreferencedLayerCount,
+		UnreferencedRawLayerCount: r.UnreferencedRawLayerCount,
+		ReclaimableBytes:          r.ReclaimableBytes,
 	}
-	containerFolder := filepath.Join(folder, "containers")
-	if !folderExists(containerFolder) {
-		fmt.Printf("Error: incorrect folder structure: expected %s to exist\n", containerFolder)
-		os.Exit(-1)
+}
+
+// writeJSONResult writes a single scanResult, or a list of them when several roots were checked.
+func writeJSONResult(w io.Writer, result interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return fmt.Errorf("Error: failed to write JSON result: %v", err)
 	}
+	return nil
+}
 
-	repoJson := filepath.Join(folder, "image", "windowsfilter", "repositories.json")
-	imageMetaDataFolder := filepath.Join(folder, "image", "windowsfilter", "imagedb", "metadata", "sha256")
-	if !folderExists(repoJson) {
-		fmt.Printf("Error: repositories.json not found! Expected %s to exist.\n", repoJson)
-		os.Exit(-1)
+// compressedWriter returns w, gzip compressed if compress is set. The returned function completes the compressed
+// stream, it has to be called once the whole report is written.
+func compressedWriter(w io.Writer, compress bool) (io.Writer, func() error) {
+	if !compress {
+		return w, func() error { return nil }
+	}
+	gz := gzip.NewWriter(w)
+	return gz, func() error {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("Error: failed to write compressed report: %v", err)
+		}
+		return nil
 	}
+}
 
-	if err := populateImageNameDB(repoJson, imageMetaDataFolder); err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+// writeLayerMap writes the images using every layer to a file, gzip compressed if compress is set. With several roots,
+// the mappings are keyed by root.
+func writeLayerMap(path string, reports []rootReport, compress bool) error {
+	var mapping interface{}
+	if len(reports) == 1 {
+		mapping = reports[0].layerImages
+	} else {
+		byRoot := make(map[string]map[string][]string)
+		for _, report := range reports {
+			if report.err == nil {
+				byRoot[report.folder] = report.layerImages
+			}
+		}
+		mapping = byRoot
+	}
+	dat, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error: failed to encode layer mapping: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error: failed to write layer mapping: %v", err)
+	}
+	defer f.Close()
+	w, closeReport := compressedWriter(f, compress)
+	if _, err := w.Write(append(dat, '\n')); err != nil {
+		return fmt.Errorf("Error: failed to write layer mapping: %v", err)
 	}
+	if err := closeReport(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error: failed to write layer mapping: %v", err)
+	}
+	return nil
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusMetrics are the metrics written by -prometheus, with the value of every root.
+var prometheusMetrics = []struct {
+	name  string
+	help  string
+	value func(r rootReport) float64
+}{
+	{"docker_leak_scan_success", "Whether the root could be scanned.", func(r rootReport) float64 {
+		if r.err != nil {
+			return 0
+		}
+		return 1
+	}},
+	{"docker_leak_unreferenced_layers", "Number of unreferenced layerDB entries.", func(r rootReport) float64 {
+		return float64(len(r.result.UnreferencedLayers))
+	}},
+	{"docker_leak_unreferenced_raw_layers", "Number of unreferenced on-disk layers.", func(r rootReport) float64 {
+		return float64(len(r.result.UnreferencedRawLayers))
+	}},
+	{"docker_leak_reclaimable_bytes", "Size of the unreferenced on-disk layers in bytes.", func(r rootReport) float64 {
+		return float64(r.reclaimable)
+	}},
+	{"docker_leak_scan_duration_seconds", "Duration of the scan in seconds.", func(r rootReport) float64 {
+		return r.duration.Seconds()
+	}},
+}
 
-	unreferencedLayers, unreferencedRawLayers, err := verifyImagesAndLayers(rawLayerFolder, layerDBFolder, imageDBFolder, containerFolder, verbose)
+// writePrometheusMetrics writes the metrics of every root, labeled with the root folder. The file is written to a
+// temporary file next to it first and then renamed, so a collector never reads a partially written file.
+func writePrometheusMetrics(path string, reports []rootReport) error {
+	var b strings.Builder
+	formatPrometheusMetrics(&b, reports)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		return fmt.Errorf("Error: failed to write metrics: %v", err)
 	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error: failed to write metrics: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error: failed to write metrics: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Error: failed to write metrics: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error: failed to write metrics: %v", err)
+	}
+	return nil
+}
 
-	if len(unreferencedLayers) != 0 || len(unreferencedRawLayers) != 0 {
-		for _, layer := range unreferencedLayers {
-			if remove {
-				fmt.Println("Info: Unreferenced layer in layerDB: ", layer, " removing...")
-				err = removeDiskLayer(layerDBFolder, layer)
-				if err != nil {
-					fmt.Println(err)
-				}
-			} else {
-				fmt.Println("Error: Unreferenced layer in layerDB: ", layer)
+// formatPrometheusMetrics writes the metrics of every root in the Prometheus text format.
+func formatPrometheusMetrics(w io.Writer, reports []rootReport) {
+	for _, metric := range prometheusMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, report := range reports {
+			if report.err != nil && metric.name != "docker_leak_scan_success" {
+				continue
 			}
+			fmt.Fprintf(w, "%s{root=\"%s\"} %v\n", metric.name, prometheusLabelEscaper.Replace(report.folder), metric.value(report))
 		}
+	}
+}
 
-		for _, layer := range unreferencedRawLayers {
-			if remove {
-				fmt.Println("Info: Unreferenced layer in windowsfilter: ", layer, " removing...")
-				err = removeDiskLayer(rawLayerFolder, layer)
-				if err != nil {
-					fmt.Println(err)
-				}
-			} else {
-				fmt.Println("Error: Unreferenced layer in windowsfilter: ", layer)
+// serve answers GET /scan with the JSON result and GET /metrics with the Prometheus metrics of a fresh scan of every
+// root. Scans run one at a time, and nothing is ever removed in this mode. It only returns if the server fails.
+func serve(addr string, folders []string, opts options) error {
+	var mu sync.Mutex
+	scan := func(ctx context.Context) []rootReport {
+		mu.Lock()
+		defer mu.Unlock()
+		reports := make([]rootReport, 0, len(folders))
+		for _, folder := range folders {
+			reports = append(reports, scanRoot(ctx, folder, opts))
+		}
+		return reports
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := http.StatusOK
+		var results []scanResult
+		for _, report := range scan(r.Context()) {
+			if report.err != nil {
+				results = append(results, scanResult{Folder: report.folder, Error: report.err.Error()})
+				status = http.StatusInternalServerError
+				continue
 			}
+			results = append(results, newScanResult(report.folder, report.result.UnreferencedLayers, report.result.UnreferencedRawLayers, report.reclaimable))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		var err error
+		if len(results) == 1 {
+			err = writeJSONResult(w, results[0])
+		} else {
+			err = writeJSONResult(w, results)
+		}
+		if err != nil {
+			printNonFatal(err)
 		}
-		os.Exit(-1)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reports := scan(r.Context())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		formatPrometheusMetrics(w, reports)
+	})
+
+	fmt.Fprintln(output, "Info: Serving /scan and /metrics on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("Error: failed to serve on %s: %v", addr, err)
 	}
-	fmt.Println("No errors found")
+	return nil
 }
 
-func createRawLayerMap(rawLayerFolder string) (map[string]*rawLayerType, error) {
-	files, err := ioutil.ReadDir(rawLayerFolder)
+// scanRoot scans a root for -serve, without printing the findings or removing anything. Like checkRoot, it leaves out
+// the entries of -ignore-file and the on-disk layers below -min-size.
+func scanRoot(ctx context.Context, folder string, opts options) rootReport {
+	report := rootReport{folder: folder}
+	scanner := newScanner(opts)
+	start := time.Now()
+	result, err := scanner.Scan(ctx, folder)
+	report.duration = time.Since(start)
 	if err != nil {
-		return nil, fmt.Errorf("Error: failed to read files in %s: %v", rawLayerFolder, err)
+		report.err = err
+		return report
 	}
-	var rawLayerMap = make(map[string]*rawLayerType)
-	for _, f := range files {
-		if f.IsDir() {
-			rawLayer := &rawLayerType{}
-			rawLayer.ID = f.Name()
-			rawLayerMap[rawLayer.ID] = rawLayer
+	folders := scanner.Folders(folder)
+	if len(opts.ignored) != 0 {
+		result = applyIgnoreList(io.Discard, scanner, folders, "", result, opts.ignored)
+	}
+	result.UnreferencedRawLayers, report.reclaimable, _, _ = filterBySize(folders.RawLayer, result.UnreferencedRawLayers, int64(opts.minSize), nil)
+	report.result = result
+	return report
+}
+
+// csvRows returns the unreferenced layers of a root as rows of kind, layer ID, size in bytes, image name and root.
+// The size is blank if it is unknown, the image name is blank unless an image uses the diff of a layerDB entry.
+func csvRows(scanner *leakcheck.Scanner, folders leakcheck.Folders, report rootReport) [][]string {
+	layerImages := scanner.LayerImages()
+	var rows [][]string
+	for _, layer := range report.result.UnreferencedLayers {
+		var size, image string
+		if dat, err := scanner.FS.ReadFile(filepath.Join(folders.LayerDB, layer, "size")); err == nil {
+			size = strings.TrimSpace(string(dat))
+		}
+		if dat, err := scanner.FS.ReadFile(filepath.Join(folders.LayerDB, layer, "diff")); err == nil {
+			image = strings.Join(layerImages[strings.TrimSpace(string(dat))], " ")
 		}
+		rows = append(rows, []string{"layerdb", layer, size, image, report.folder})
 	}
-	return rawLayerMap, nil
+	for _, layer := range report.result.UnreferencedRawLayers {
+		var size string
+		if !leakcheck.IsTarArchive(folders.Root) {
+			bytes, _ := leakcheck.LayerSize(filepath.Join(folders.RawLayer, layer))
+			size = strconv.FormatInt(bytes, 10)
+		}
+		rows = append(rows, []string{folders.Driver, layer, size, "", report.folder})
+	}
+	return rows
 }
 
-func populateImageNameDB(reposJson string, imageMetadataFolder string) error {
-	const shaPrefix = "sha256:"
-	dat, err := ioutil.ReadFile(reposJson)
-	if err != nil {
-		return fmt.Errorf("failed to read file %s: %v", reposJson, err)
+// writeCSVResult writes the unreferenced layers of all roots that could be scanned, preceded by a header row.
+func writeCSVResult(w io.Writer, reports []rootReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"type", "layer", "size_bytes", "image", "root"})
+	for _, report := range reports {
+		out.WriteAll(report.csvRows)
 	}
-	var result map[string]interface{}
-	if err := json.Unmarshal(dat, &result); err != nil {
-		return fmt.Errorf("failed to unmarshal json: %v", err)
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return fmt.Errorf("Error: failed to write CSV result: %v", err)
 	}
+	return nil
+}
 
-	entries := result["Repositories"].(map[string]interface{})
-	for _, value := range entries {
-		// key is the image/repo name without tags
-		// value is another map with full name + tag as key and sha256 as value
-		for tag, sha := range value.(map[string]interface{}) {
-			if strings.Contains(tag, "@sha256") {
-				// there are these extra entries that look like a sha for the tag. Not really sure what they are used for.
-				continue
-			}
-			// Need to remove the sha256: prefix from the sha sums still.
-			shaKey := strings.TrimPrefix(sha.(string), shaPrefix)
-			imageNameDB[shaSum(shaKey)] = tag
-		}
+// jsonSummary is the single line summary of a root printed by -json-summary.
+type jsonSummary struct {
+	Folder                    string  `json:"folder"`
+	LayerCount                int     `json:"layerCount"`
+	RawLayerCount             int     `json:"rawLayerCount"`
+	UnreferencedLayerCount    int     `json:"unreferencedLayerCount"`
+	UnreferencedRawLayerCount int     `json:"unreferencedRawLayerCount"`
+	ReclaimableBytes          int64   `json:"reclaimableBytes"`
+	DurationSeconds           float64 `json:"durationSeconds"`
+	Error                     string  `json:"error,omitempty"`
+}
+
+func writeJSONSummary(w io.Writer, report rootReport) error {
+	summary := jsonSummary{
+		Folder:                    report.folder,
+		LayerCount:                report.result.LayerCount,
+		RawLayerCount:             report.result.RawLayerCount,
+		UnreferencedLayerCount:    len(report.result.UnreferencedLayers),
+		UnreferencedRawLayerCount: len(report.result.UnreferencedRawLayers),
+		ReclaimableBytes:          report.reclaimable,
+		DurationSeconds:           report.duration.Seconds(),
+	}
+	if report.err != nil {
+		summary.Error = report.err.Error()
+	}
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		return fmt.Errorf("Error: failed to write JSON summary: %v", err)
 	}
-	// This takes care of the 'top level' images. However, we also have a parent-child relation, where (unnamed) images
-	// are children of one of the 'top level' images. Hence we need to walk the imagesDB folder and follow these relations.
-	files, err := ioutil.ReadDir(imageMetadataFolder)
+	return nil
+}
+
+// removal is an unreferenced layer folder that is scheduled for removal.
+type removal struct {
+	folder string
+	layer  string
+	kind   string
+	// Image metadata is plain files and folders, which are not managed by the storage driver.
+	metadata bool
+}
+
+// deleteEntry permanently deletes a layer or metadata entry.
+func deleteEntry(r removal) error {
+	path, err := layerPath(r.folder, r.layer)
 	if err != nil {
-		return fmt.Errorf("failed to read files in %s", imageMetadataFolder)
+		return err
+	}
+	// never recurse through a junction or symbolic link, that would delete the contents of its target
+	if info, err := os.Lstat(leakcheck.LongPath(path)); err == nil && leakcheck.IsLink(info) {
+		fmt.Fprintf(output, "Info: %s is a junction or symbolic link, removing only the link\n", path)
+		return os.Remove(leakcheck.LongPath(path))
+	}
+	if r.metadata {
+		return os.RemoveAll(leakcheck.LongPath(path))
+	}
+	return removeDiskLayer(r.folder, r.layer)
+}
+
+// layerPath joins a folder and the name of a layer in it. As the result is about to be removed, the name has to be a
+// plain folder name, so a corrupted or crafted layer ID can never point outside of the folder.
+func layerPath(folder, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("refusing to remove %q, it is not a plain folder name", name)
 	}
+	path := filepath.Join(folder, name)
+	rel, err := filepath.Rel(filepath.Clean(folder), path)
+	if err != nil || rel != name {
+		return "", fmt.Errorf("refusing to remove %q, it is not located in %s", name, folder)
+	}
+	return path, nil
+}
 
-	childParent := make(map[shaSum]shaSum)
-	for _, d := range files {
-		if d.IsDir() {
-			child := d.Name()
-			// parent id should be stored in a file called 'parent' inside the folder
-			parentFile := filepath.Join(imageMetadataFolder, d.Name(), "parent")
-			dat, err := ioutil.ReadFile(parentFile)
+// lockRoot makes sure only one instance removes layers from a root at a time. The lock file lives in the temp folder,
+// named after the root, and holds the PID of its owner. Locks of processes that are gone are taken over. The returned
+// function releases the lock.
+func lockRoot(folder string) (func(), error) {
+	abs, err := filepath.Abs(folder)
+	if err != nil {
+		abs = folder
+	}
+	if runtime.GOOS == "windows" {
+		abs = strings.ToLower(abs)
+	}
+	h := sha256.Sum256([]byte(abs))
+	path := filepath.Join(os.TempDir(), "docker-leak-check-"+hex.EncodeToString(h[:8])+".lock")
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
 			if err != nil {
-				fmt.Println("Error: Unable to read parent info for image id ", child)
-				continue
+				os.Remove(path)
+				return nil, fmt.Errorf("Error: failed to write lock file %s: %v", path, err)
 			}
-			parent := strings.TrimPrefix(string(dat), shaPrefix)
-			childParent[shaSum(child)] = shaSum(parent)
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Error: failed to create lock file %s: %v", path, err)
+		}
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to read lock file %s: %v", path, err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(dat)))
+		if err == nil && processAlive(pid) {
+			return nil, fmt.Errorf("Error: another instance (PID %d) is removing layers from %s, remove %s if this is not the case", pid, folder, path)
+		}
+		fmt.Fprintln(output, "Info: Taking over stale lock file ", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error: failed to remove stale lock file %s: %v", path, err)
 		}
 	}
+	return nil, fmt.Errorf("Error: failed to acquire lock file %s", path)
+}
 
-	findLeafImages(childParent)
-	return nil
+// isTerminal reports whether the file is a terminal rather than a pipe or a regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func findLeafImages(childParent map[shaSum]shaSum) {
-	// there are more optimal ways to do this, but should be okay since the number of images will generally be small.
-	for child, parent := range childParent {
-		for {
-			if val, exists := childParent[parent]; exists {
-				parent = val
-				continue
-			} else if leaf, ok := imageNameDB[parent]; ok {
-				imageNameDB[child] = leaf + " (inheritance chain)"
-				break
-			} else {
-				// dangling image
-				fmt.Println("Dangling image found: ", parent)
-				break
-			}
+// ANSI escape sequences used by colorWriter.
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorGreen  = "\x1b[32m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorLabel matches the label of a root that precedes the findings when several roots are checked.
+var colorLabel = regexp.MustCompile(`^\[[^\]]*\] `)
+
+// colorWriter colors the lines written to a terminal by their kind: errors and leaks red, warnings yellow and the
+// clean summary green. Other lines are written unchanged.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	text := string(p)
+	line := colorLabel.ReplaceAllString(text, "")
+	var color string
+	switch {
+	case strings.HasPrefix(line, "Error:"):
+		color = colorRed
+	case strings.HasPrefix(line, "WARN:"):
+		color = colorYellow
+	case strings.HasPrefix(line, "No errors found"):
+		color = colorGreen
+	default:
+		return c.w.Write(p)
+	}
+	body := strings.TrimRight(text, "\n")
+	if _, err := io.WriteString(c.w, color+body+colorReset+text[len(body):]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// confirmRemoval asks the user on stdin whether the given layers should really be removed. Without a terminal
+// nobody can answer, so it refuses instead of waiting forever.
+func confirmRemoval(removals []removal, estimate int64) (bool, error) {
+	if !isTerminal(os.Stdin) {
+		return false, fmt.Errorf("Error: stdin is not a terminal, pass -yes to remove layers without confirmation")
+	}
+	counts := make(map[string]int)
+	var kinds []string
+	for _, r := range removals {
+		if counts[r.kind] == 0 {
+			kinds = append(kinds, r.kind)
 		}
+		counts[r.kind]++
 	}
+	var summary []string
+	for _, kind := range kinds {
+		summary = append(summary, fmt.Sprintf("%d %s entries", counts[kind], kind))
+	}
+	fmt.Fprintf(errOutput, "About to remove %s, freeing about %s. Continue? [y/N] ", strings.Join(summary, " and "), humanSize(estimate))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(errOutput)
+		return false, fmt.Errorf("Error: no confirmation received on stdin, pass -yes to remove layers without confirmation")
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// removalFailure is a layer that could not be removed, along with the reason why.
+type removalFailure struct {
+	removal
+	err error
 }
 
-func populateLayerDBMap(layerDBFolder string) (map[string]*layerDBItem, error) {
-	// enumerate the existing layers in the LayerDB
-	files, err := ioutil.ReadDir(layerDBFolder)
+type removeOptions struct {
+	concurrency int
+	dryRun      bool
+	// Move the layers into this folder instead of deleting them.
+	quarantine string
+	// Record every removal in this log, if set.
+	audit *auditLog
+}
+
+// auditEntry is a single line of the -log-file audit log.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Layer      string    `json:"layer"`
+	Path       string    `json:"path"`
+	BytesFreed int64     `json:"bytesFreed"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditLog appends a JSON line for every removal, so there is a persistent record of what was removed and when.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *auditLog) record(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	dat, err := json.Marshal(entry)
 	if err != nil {
-		return nil, fmt.Errorf("Error: failed to read files in %s: %v", layerDBFolder, err)
+		printNonFatal("WARN: Failed to write audit log entry: ", err)
+		return
 	}
-	var layerMap = make(map[string]*layerDBItem)
-	for _, f := range files {
-		if f.IsDir() {
-			layer := &layerDBItem{}
-			layer.ID = f.Name()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(dat, '\n')); err != nil {
+		printNonFatal("WARN: Failed to write audit log entry: ", err)
+	}
+}
 
-			diffFile := filepath.Join(layerDBFolder, f.Name(), "diff")
-			dat, err := ioutil.ReadFile(diffFile)
-			if err != nil {
-				return nil, fmt.Errorf("Error: failed to read file %s: %v", diffFile, err)
+// removeLayers removes the given layers, running up to opts.concurrency removals in parallel. Every removal targets
+// its own folder, so they don't interfere with each other. If a quarantine folder is given, the layers are moved there
+// instead. In dry-run mode, the folders are only listed. Returns the removals that failed, so they can be summarized
+// once all removals are done.
+func removeLayers(removals []removal, opts removeOptions) ([]removalFailure, int64) {
+	quarantine := opts.quarantine
+	if opts.dryRun {
+		for _, r := range removals {
+			if quarantine != "" {
+				fmt.Fprintln(output, "Info: Unreferenced layer in "+r.kind+": ", r.layer, " would move ", filepath.Join(r.folder, r.layer), " to ", quarantine)
+				continue
+			}
+			fmt.Fprintln(output, "Info: Unreferenced layer in "+r.kind+": ", r.layer, " would remove ", filepath.Join(r.folder, r.layer))
+		}
+		return nil, 0
+	}
+	var mu sync.Mutex
+	var failures []removalFailure
+	var freed int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.concurrency)
+	for _, r := range removals {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r removal) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			path := filepath.Join(r.folder, r.layer)
+			// measured right before the removal, the layer may have changed since the estimate
+			size, _ := leakcheck.LayerSize(path)
+			var err error
+			if quarantine != "" {
+				fmt.Fprintln(output, "Info: Unreferenced layer in "+r.kind+": ", r.layer, " moving to quarantine...")
+				err = quarantineLayer(r, quarantine)
+			} else {
+				fmt.Fprintln(output, "Info: Unreferenced layer in "+r.kind+": ", r.layer, " removing...")
+				err = deleteEntry(r)
+			}
+			entry := auditEntry{Time: time.Now(), Kind: r.kind, Layer: r.layer, Path: path, BytesFreed: size, Success: err == nil}
+			// the log outlives the run, so a path relative to the working directory of the run would be ambiguous
+			if abs, err := filepath.Abs(path); err == nil {
+				entry.Path = abs
 			}
-			layer.diff = string(dat)
-
-			cacheIDFile := filepath.Join(layerDBFolder, f.Name(), "cache-id")
-			dat, err = ioutil.ReadFile(cacheIDFile)
 			if err != nil {
-				return nil, fmt.Errorf("Error: failed to read file %s: %v", cacheIDFile, err)
+				entry.BytesFreed = 0
+				entry.Error = err.Error()
+				mu.Lock()
+				failures = append(failures, removalFailure{removal: r, err: err})
+				mu.Unlock()
+			} else {
+				mu.Lock()
+				freed += size
+				mu.Unlock()
 			}
-			layer.cacheID = string(dat)
+			opts.audit.record(entry)
+		}(r)
+	}
+	wg.Wait()
+	sort.Slice(failures, func(i, j int) bool {
+		return filepath.Join(failures[i].folder, failures[i].layer) < filepath.Join(failures[j].folder, failures[j].layer)
+	})
+	return failures, freed
+}
 
-			layerMap[layer.diff] = layer
-		}
+// estimateRemovals returns the number of bytes the removals are expected to free.
+func estimateRemovals(removals []removal) int64 {
+	var total int64
+	for _, r := range removals {
+		size, _ := leakcheck.LayerSize(filepath.Join(r.folder, r.layer))
+		total += size
 	}
-	return layerMap, nil
+	return total
 }
 
-func verifyLayersOfImage(imagePath string, sha shaSum, layerMap map[string]*layerDBItem, rawLayerMap map[string]*rawLayerType, verbose bool) error {
-	dat, err := ioutil.ReadFile(imagePath)
+// quarantineLayer moves a layer folder into the quarantine folder, keeping its name, so it can be restored later. Every
+// kind of entry gets its own subfolder, since e.g. the content and metadata of an image share their name. If the
+// quarantine folder is on another volume, the layer is copied and then deleted. Existing entries in the quarantine
+// folder are never overwritten.
+func quarantineLayer(r removal, quarantine string) error {
+	src, err := layerPath(r.folder, r.layer)
 	if err != nil {
-		return fmt.Errorf("Error: failed to read file %s: %v", imagePath, err)
+		return err
 	}
-	image := &imageType{}
-	if err := json.Unmarshal(dat, image); err != nil {
-		return fmt.Errorf("Error: failed to read JSON contents of %s: %v", imagePath, err)
+	kindFolder := filepath.Join(quarantine, strings.ReplaceAll(r.kind, " ", "-"))
+	dst := filepath.Join(kindFolder, r.layer)
+	if found, err := leakcheck.FolderExists(dst); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("%s already exists in quarantine", r.layer)
 	}
-
-	if image.OS == "linux" {
-		fmt.Printf("WARN: Skipping linux %s\n", imagePath)
+	if err := os.MkdirAll(kindFolder, 0700); err != nil {
+		return fmt.Errorf("failed to create quarantine folder: %v", err)
+	}
+	// only a move to another volume is done by copying, any other failure would leave a partial copy behind
+	if err := os.Rename(leakcheck.LongPath(src), leakcheck.LongPath(dst)); err == nil {
 		return nil
+	} else if !crossDevice(err) {
+		return fmt.Errorf("failed to move %s to quarantine: %v", src, err)
 	}
+	if err := copyTree(leakcheck.LongPath(src), leakcheck.LongPath(dst)); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("failed to copy %s to quarantine: %v", src, err)
+	}
+	return deleteEntry(r)
+}
 
-	for _, diff := range image.RootFS.DiffIDs {
-		layer := layerMap[diff]
-		if layer == nil {
-			return fmt.Errorf("Error: expected layer with diff %s", diff)
+// copyTree copies a folder with all of its files, folders and symbolic links.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-		if rawLayerMap[layer.cacheID] == nil {
-			return fmt.Errorf("Error: expected on-disk layer %s\n", layer.cacheID)
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
 		}
-		rawLayerMap[layer.cacheID].visited = true
-		layer.visited = true
-		if verbose {
-			humanReadable := "(sha256:" + string(sha) + ")"
-			if name, found := imageNameDB[sha]; found {
-				humanReadable = name
-			}
-			//fmt.Println("Info: Found layer ", diff, " belonging to image ", humanReadable)
-			layerSha := shaSum(diff)
-			if _, exists := layerImageDB[layerSha]; !exists {
-				layerImageDB[layerSha] = make(map[string]struct{})
+		target := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case leakcheck.IsLink(info):
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
 			}
-			layerImageDB[layerSha][humanReadable] = struct{}{}
+			return os.Symlink(link, target)
+		case mode.IsDir():
+			return os.MkdirAll(target, mode.Perm())
+		case mode.IsRegular():
+			return copyFile(path, target, mode.Perm())
+		default:
+			return fmt.Errorf("unsupported file type of %s", path)
 		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
-	return nil
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
 
-func verifyImages(imageDBFolder string, layerMap map[string]*layerDBItem, rawLayerMap map[string]*rawLayerType, verbose bool) error {
-	files, err := ioutil.ReadDir(imageDBFolder)
+// printRemovalSummary prints how many of the removals succeeded, followed by every removal that failed.
+func printRemovalSummary(removals []removal, failures []removalFailure, freed, estimate int64) {
+	fmt.Fprintf(output, "Info: Removed %d of %d entries, %d failed, freed %s of an estimated %s\n",
+		len(removals)-len(failures), len(removals), len(failures), humanSize(freed), humanSize(estimate))
+	for _, f := range failures {
+		printNonFatal("Error: Failed to remove ", filepath.Join(f.folder, f.layer), ": ", f.err)
+	}
+}
+
+// modifiedWithin reports whether the given path or anything inside of it was modified within the given time window.
+// Extracting a layer doesn't necessarily update the modification time of its folder.
+func modifiedWithin(path string, window time.Duration) (bool, error) {
+	newest, err := leakcheck.NewestModTime(path)
 	if err != nil {
-		return fmt.Errorf("Error: failed to read files in %s: %v", imageDBFolder, err)
+		return false, err
 	}
-	for _, f := range files {
-		if !f.IsDir() {
-			imagePath := filepath.Join(imageDBFolder, f.Name())
-			err := verifyLayersOfImage(imagePath, shaSum(f.Name()), layerMap, rawLayerMap, verbose)
-			if err != nil {
-				return err
-			}
-		}
+	return time.Since(newest) < window, nil
+}
+
+// rootGraph is the set of images and layers found in a Docker runtime root, used to compare two roots.
+type rootGraph struct {
+	images                map[string]struct{}
+	layers                map[string]struct{}
+	rawLayers             map[string]struct{}
+	unreferencedLayers    map[string]struct{}
+	unreferencedRawLayers map[string]struct{}
+}
+
+func toSet(items []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
 	}
+	return set
+}
 
-	if verbose {
-		for layerId, images := range layerImageDB {
-			fmt.Println("Found layer ", layerId, " belonging to the following images:")
-			imageNames := make([]string, 0, len(images))
+func folderEntries(folder string) (map[string]struct{}, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", folder, err)
+	}
+	entries := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		entries[f.Name()] = struct{}{}
+	}
+	return entries, nil
+}
 
-			for img := range images {
-				imageNames = append(imageNames, img)
-			}
-			sort.Strings(imageNames)
+func scanRootGraph(ctx context.Context, root, driver string) (*rootGraph, error) {
+	scanner := leakcheck.NewScanner(driver)
+	result, err := scanner.Scan(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	folders := scanner.Folders(root)
+	graph := &rootGraph{
+		unreferencedLayers:    toSet(result.UnreferencedLayers),
+		unreferencedRawLayers: toSet(result.UnreferencedRawLayers),
+	}
+	if graph.images, err = folderEntries(folders.ImageDB); err != nil {
+		return nil, err
+	}
+	if graph.layers, err = folderEntries(folders.LayerDB); err != nil {
+		return nil, err
+	}
+	if graph.rawLayers, err = folderEntries(folders.RawLayer); err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
 
-			for _, name := range imageNames {
-				fmt.Println("\t", name)
+// printSetDifference prints the entries that are only present in one of the two sets and reports whether there were any.
+func printSetDifference(what string, a, b map[string]struct{}, rootA, rootB string) bool {
+	different := false
+	for _, pair := range []struct {
+		from, to map[string]struct{}
+		root     string
+	}{{a, b, rootA}, {b, a, rootB}} {
+		var only []string
+		for item := range pair.from {
+			if _, found := pair.to[item]; !found {
+				only = append(only, item)
 			}
-			fmt.Println()
+		}
+		sort.Strings(only)
+		for _, item := range only {
+			fmt.Fprintf(output, "Error: %s only in %s: %s\n", what, pair.root, item)
+			different = true
 		}
 	}
-	return nil
+	return different
 }
 
-func visitContainerLayers(containerFolder string, rawLayerMap map[string]*rawLayerType) error {
-	files, err := ioutil.ReadDir(containerFolder)
+// compareRoots scans two Docker runtime roots and prints the differences between their images, layers and
+// unreferenced layers. This is useful to validate that a migrated store is equivalent to the original one.
+func compareRoots(ctx context.Context, rootA, rootB, driver string) (bool, error) {
+	graphA, err := scanRootGraph(ctx, rootA, driver)
 	if err != nil {
-		return fmt.Errorf("Error: failed to read files in %s: %v", containerFolder, err)
+		return false, err
 	}
-	for _, f := range files {
-		if f.IsDir() {
-			layer := rawLayerMap[f.Name()]
-			if layer != nil {
-				layer.visited = true
+	graphB, err := scanRootGraph(ctx, rootB, driver)
+	if err != nil {
+		return false, err
+	}
+	different := printSetDifference("Image", graphA.images, graphB.images, rootA, rootB)
+	different = printSetDifference("LayerDB entry", graphA.layers, graphB.layers, rootA, rootB) || different
+	different = printSetDifference("Layer in "+driver, graphA.rawLayers, graphB.rawLayers, rootA, rootB) || different
+	different = printSetDifference("Unreferenced layer in layerDB", graphA.unreferencedLayers, graphB.unreferencedLayers, rootA, rootB) || different
+	different = printSetDifference("Unreferenced layer in "+driver, graphA.unreferencedRawLayers, graphB.unreferencedRawLayers, rootA, rootB) || different
+	return different, nil
+}
+
+// printLayerImages prints every layer along with the images it belongs to.
+func printLayerImages(layerImages map[string][]string) {
+	for layerId, imageNames := range layerImages {
+		fmt.Fprintln(output, "Found layer ", layerId, " belonging to the following images:")
+		for _, name := range imageNames {
+			fmt.Fprintln(output, "\t", name)
+		}
+		fmt.Fprintln(output)
+	}
+}
+
+// printLayerRefCounts prints every layer along with the number of images using it, most shared layers first.
+func printLayerRefCounts(layerImages map[string][]string) {
+	layers := make([]string, 0, len(layerImages))
+	for layerId := range layerImages {
+		layers = append(layers, layerId)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		a, b := len(layerImages[layers[i]]), len(layerImages[layers[j]])
+		if a != b {
+			return a > b
+		}
+		return layers[i] < layers[j]
+	})
+	for _, layerId := range layers {
+		fmt.Fprintf(output, "%6d  %s\n", len(layerImages[layerId]), layerId)
+	}
+}
+
+// printImageStats lists the disk space used by the layers of every image, largest first. Layers shared by several
+// images are either split evenly between them or counted fully for every one of them.
+func printImageStats(scanner *leakcheck.Scanner, rawLayerFolder string, split bool) {
+	layerImages := scanner.LayerImages()
+	layerRaw := scanner.LayerRawFolders()
+	imageSizes := make(map[string]int64)
+	for layer, images := range layerImages {
+		var size int64
+		for _, folder := range layerRaw[layer] {
+			layerSize, skipped := leakcheck.LayerSize(filepath.Join(rawLayerFolder, folder))
+			for _, path := range skipped {
+				printNonFatal("WARN: Could not determine size of ", path)
 			}
+			size += layerSize
+		}
+		if split {
+			size /= int64(len(images))
+		}
+		for _, image := range images {
+			imageSizes[image] += size
 		}
 	}
-	return nil
+	images := make([]string, 0, len(imageSizes))
+	for image := range imageSizes {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		a, b := imageSizes[images[i]], imageSizes[images[j]]
+		if a != b {
+			return a > b
+		}
+		return images[i] < images[j]
+	})
+	tw := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	for _, image := range images {
+		fmt.Fprintf(tw, "%s\t%s\n", humanSize(imageSizes[image]), image)
+	}
+	tw.Flush()
 }
 
-func verifyImagesAndLayers(rawLayerFolder, layerDBFolder, imageDBFolder, containerFolder string, verbose bool) ([]string, []string, error) {
-	rawLayerMap, err := createRawLayerMap(rawLayerFolder)
-	if err != nil {
-		return nil, nil, err
+// printLayerUsers prints the images using a layer, or that none does.
+func printLayerUsers(scanner *leakcheck.Scanner, layer string) {
+	diff, images, found := scanner.LayerUsers(layer)
+	if !found {
+		fmt.Fprintf(output, "Layer %s is not used by any image\n", layer)
+		return
+	}
+	fmt.Fprintf(output, "Layer %s (diff %s) is used by the following images:\n", layer, diff)
+	for _, image := range images {
+		fmt.Fprintln(output, "\t", image)
 	}
+}
 
-	layerMap, err := populateLayerDBMap(layerDBFolder)
+// printImageLayers prints the layers of an image in the order of its diff IDs, one per line with the layerDB ID,
+// cache-id and on-disk path. Missing parts are shown as '-'. It reports whether any of them is missing.
+func printImageLayers(scanner *leakcheck.Scanner, folders leakcheck.Folders, nameOrSha string) (bool, error) {
+	image, err := scanner.FindImage(folders, nameOrSha)
 	if err != nil {
-		return nil, nil, err
+		return false, err
+	}
+	broken := false
+	tw := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tDIFF ID\tLAYERDB ID\tCACHE-ID\tPATH")
+	for i, layer := range image.Layers {
+		broken = broken || layer.Broken()
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i, layer.DiffID, orDash(layer.LayerDBID), orDash(layer.CacheID), orDash(layer.Path))
 	}
+	tw.Flush()
+	return broken, nil
+}
 
-	err = verifyImages(imageDBFolder, layerMap, rawLayerMap, verbose)
-	if err != nil {
-		return nil, nil, err
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
+	return s
+}
 
-	err = visitContainerLayers(containerFolder, rawLayerMap)
-	if err != nil {
-		return nil, nil, err
+// isCycle reports whether the last image of a chain already occurred earlier in the chain.
+func isCycle(chain []string) bool {
+	top := chain[len(chain)-1]
+	for _, sha := range chain[:len(chain)-1] {
+		if sha == top {
+			return true
+		}
+	}
+	return false
+}
+
+// printInheritanceChains prints the resolved inheritance chains, ending in the image name if the chain could be
+// resolved to a named image.
+func printInheritanceChains(scanner *leakcheck.Scanner) {
+	chains := scanner.InheritanceChains()
+	children := make([]string, 0, len(chains))
+	for child := range chains {
+		children = append(children, child)
 	}
+	sort.Strings(children)
 
-	var unreferencedLayers []string
-	for _, layer := range layerMap {
-		if layer.visited == false {
-			unreferencedLayers = append(unreferencedLayers, layer.ID)
+	for _, child := range children {
+		chain := chains[child]
+		links := append([]string{}, chain...)
+		top := chain[len(chain)-1]
+		if name, found := scanner.ImageName(top); found {
+			links = append(links, name)
+		} else if isCycle(chain) {
+			links = append(links, "(cycle)")
+		} else {
+			links = append(links, "(dangling)")
 		}
+		fmt.Fprintln(output, strings.Join(links, " -> "))
+	}
+}
+
+// printDanglingChains lists the images whose inheritance chain ends at a parent without a name. With verbose, the
+// chains from the youngest children up to the dangling parent are shown as well, since those images can't be named.
+func printDanglingChains(result leakcheck.Result, verbose bool) {
+	for _, parent := range result.DanglingImages {
+		chains := result.DanglingChains[parent]
+		fmt.Fprintf(output, "Info: Dangling parent image %s without a name is inherited by %d image chains\n", parent, len(chains))
+		if !verbose {
+			continue
+		}
+		for _, chain := range chains {
+			fmt.Fprintln(output, "\t", strings.Join(chain, " -> "))
+		}
+	}
+}
+
+// humanSize formats a byte count using binary units.
+func humanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// printImageLayerTree prints every layer of a single image along with its layerDB entry, cache-id and on-disk state.
+// It reports whether any of the layers is broken.
+func printImageLayerTree(scanner *leakcheck.Scanner, folders leakcheck.Folders, nameOrSha string) (bool, error) {
+	image, err := scanner.InspectImage(folders, nameOrSha)
+	if err != nil {
+		return false, err
 	}
 
-	var unreferencedRawLayers []string
-	for _, rawLayer := range rawLayerMap {
-		if rawLayer.visited == false {
-			unreferencedRawLayers = append(unreferencedRawLayers, rawLayer.ID)
+	name := image.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	fmt.Fprintf(output, "%s (sha256:%s), os %s\n", name, image.ID, image.OS)
+	broken := false
+	for i, layer := range image.Layers {
+		fmt.Fprintf(output, "  [%d] %s\n", i, layer.DiffID)
+		if layer.LayerDBID == "" {
+			fmt.Fprintln(output, "      layerDB:  MISSING")
+			broken = true
+			continue
+		}
+		fmt.Fprintln(output, "      layerDB: ", layer.LayerDBID)
+		fmt.Fprintln(output, "      cache-id:", layer.CacheID)
+		if !layer.OnDisk {
+			fmt.Fprintln(output, "      on disk:  MISSING")
+			broken = true
+			continue
+		}
+		if layer.SizeErr != nil {
+			fmt.Fprintf(output, "      on disk:  present, size unknown (%v)\n", layer.SizeErr)
+			continue
 		}
+		fmt.Fprintf(output, "      on disk:  present, %s in %d files\n", humanSize(layer.Size), layer.Files)
 	}
-	return unreferencedLayers, unreferencedRawLayers, nil
+	return broken, nil
 }
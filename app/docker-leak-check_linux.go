@@ -3,10 +3,53 @@
 package main
 
 import (
+	"errors"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
+// enableColor reports whether the terminal renders ANSI colors, which terminals on Linux do.
+func enableColor() bool {
+	return true
+}
+
+// crossDevice reports whether a rename failed because the source and destination are on different file systems.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
 func removeDiskLayer(location, foldername string) error {
-	return os.RemoveAll(filepath.Join(location, foldername))
+	path, err := layerPath(location, foldername)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+func openEventLog() (eventLogger, error) {
+	return nil, errors.New("Error: -eventlog is only supported on Windows")
+}
+
+// dockerRunning checks whether the process recorded in the pid file of dockerd is still alive.
+func dockerRunning() (bool, error) {
+	dat, err := os.ReadFile("/var/run/docker.pid")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(dat)))
+	if err != nil {
+		return false, nil
+	}
+	return processAlive(pid), nil
+}
+
+// processAlive reports whether a process with the given PID exists. EPERM means it exists, but belongs to another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
 }
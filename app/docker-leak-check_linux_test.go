@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCrossDevice(t *testing.T) {
+	if !crossDevice(&os.LinkError{Op: "rename", Err: syscall.EXDEV}) {
+		t.Errorf("crossDevice(EXDEV) = false, expected true")
+	}
+	for _, errno := range []syscall.Errno{syscall.EACCES, syscall.EBUSY, syscall.EEXIST, syscall.EINVAL} {
+		if crossDevice(&os.LinkError{Op: "rename", Err: errno}) {
+			t.Errorf("crossDevice(%v) = true, expected false", errno)
+		}
+	}
+}
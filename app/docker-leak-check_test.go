@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressedReport(t *testing.T) {
+	want := newScanResult("/var/lib/docker", []string{"abc"}, []string{"def", "ghi"}, 1234)
+	var buf bytes.Buffer
+	w, closeReport := compressedWriter(&buf, true)
+	if err := writeJSONResult(w, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeReport(); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("report is not gzip compressed: %v", err)
+	}
+	var got scanResult
+	if err := json.NewDecoder(gz).Decode(&got); err != nil {
+		t.Fatalf("failed to decode compressed report: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compressed report = %+v, expected %+v", got, want)
+	}
+}
+
+func TestWriteLayerMapCompressed(t *testing.T) {
+	want := map[string][]string{"sha256:abc": {"app:latest", "tool:1"}}
+	path := filepath.Join(t.TempDir(), "map.json.gz")
+	if err := writeLayerMap(path, []rootReport{{folder: "/var/lib/docker", layerImages: want}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("layer map is not gzip compressed: %v", err)
+	}
+	dat, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress layer map: %v", err)
+	}
+	var got map[string][]string
+	if err := json.Unmarshal(dat, &got); err != nil {
+		t.Fatalf("failed to decode layer map: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("layer map = %v, expected %v", got, want)
+	}
+}
+
+// emptyRoot creates an overlay2 Docker runtime root without any images.
+func emptyRoot(t *testing.T) string {
+	root := t.TempDir()
+	for _, folder := range []string{"image/overlay2/imagedb/content/sha256", "image/overlay2/imagedb/metadata/sha256", "image/overlay2/layerdb/sha256", "overlay2", "containers"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(folder)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "image", "overlay2", "repositories.json"), []byte(`{"Repositories":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestCheckRootReportsErrors(t *testing.T) {
+	defer func(w io.Writer) { output = w }(output)
+	output = ioutil.Discard
+	// an error after the scan has to end up in the report of the root rather than exit, so other roots are still checked
+	opts := options{driver: "overlay2", concurrency: 1, maxChainDepth: 10, untagged: true, skipInheritance: true}
+	report := checkRoot(emptyRoot(t), "[root] ", opts)
+	if report.err == nil {
+		t.Fatalf("checkRoot() succeeded, expected -images-without-repo-tag to fail with -skip-inheritance")
+	}
+	if outcome := report.outcome(); outcome != outcomeError {
+		t.Errorf("outcome() = %s, expected %s", outcome, outcomeError)
+	}
+}
+
+func TestQuarantineLayerRenameError(t *testing.T) {
+	folder := t.TempDir()
+	layer := filepath.Join(folder, "layer")
+	if err := os.MkdirAll(filepath.Join(layer, "diff"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layer, "diff", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a folder can't be moved into itself, which must not be mistaken for a move to another volume
+	quarantine := filepath.Join(layer, "quarantine")
+	err := quarantineLayer(removal{folder: folder, layer: "layer", kind: "overlay2"}, quarantine)
+	if err == nil {
+		t.Fatalf("quarantineLayer() succeeded, expected the rename to fail")
+	}
+	if !strings.Contains(err.Error(), "failed to move") {
+		t.Errorf("quarantineLayer() error = %v, expected the rename error rather than a copy", err)
+	}
+	if _, err := os.Stat(filepath.Join(layer, "diff", "file")); err != nil {
+		t.Errorf("layer was modified by the failed quarantine: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, "overlay2", "layer")); !os.IsNotExist(err) {
+		t.Errorf("failed quarantine left a copy behind: %v", err)
+	}
+}
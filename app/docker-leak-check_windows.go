@@ -3,13 +3,122 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/Microsoft/hcsshim"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// enableColor turns on the processing of ANSI escape sequences by the console of stdout. Consoles older than Windows 10
+// don't support it, the output isn't colored there.
+func enableColor() bool {
+	handle := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return false
+	}
+	return windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+}
+
+// crossDevice reports whether a rename failed because the source and destination are on different volumes.
+func crossDevice(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
+
+// eventSource is the source of the events written to the Application event log.
+const eventSource = "docker-leak-check"
+
+// openEventLog registers the event source, unless that happened before, and opens the Application event log.
+// Registering requires administrative rights, which removing layers needs anyway.
+func openEventLog() (eventLogger, error) {
+	err := eventlog.InstallAsEventCreate(eventSource, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "exists") {
+		return nil, fmt.Errorf("Error: failed to register event source %s: %v", eventSource, err)
+	}
+	l, err := eventlog.Open(eventSource)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to open the event log: %v", err)
+	}
+	return l, nil
+}
+
+// removeAttempts and removeBackoff bound the retries of removeDiskLayer. The delay doubles after every attempt.
+const (
+	removeAttempts = 3
+	removeBackoff  = time.Second
 )
 
+// removeDiskLayer destroys a layer, retrying a few times since files like layer.vhdx are often held briefly by
+// background processes, e.g. virus scanners, even when Docker is stopped. The error of the last attempt is returned.
 func removeDiskLayer(location, foldername string) error {
+	if _, err := layerPath(location, foldername); err != nil {
+		return err
+	}
 	info := hcsshim.DriverInfo{
 		HomeDir: location,
 		Flavour: 0,
 	}
-	return hcsshim.DestroyLayer(info, foldername)
+	var err error
+	delay := removeBackoff
+	for attempt := 1; attempt <= removeAttempts; attempt++ {
+		if err = hcsshim.DestroyLayer(info, foldername); err == nil {
+			return nil
+		}
+		if attempt < removeAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// processAlive reports whether a process with the given PID is still running. Processes that can't be opened for
+// lack of permissions exist as well.
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err == windows.ERROR_ACCESS_DENIED {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	// STILL_ACTIVE
+	return code == 259
+}
+
+// dockerRunning asks the service control manager whether the docker service is running. A missing service is taken
+// as not running.
+func dockerRunning() (bool, error) {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return false, err
+	}
+	defer windows.CloseServiceHandle(m)
+	name, err := windows.UTF16PtrFromString("docker")
+	if err != nil {
+		return false, err
+	}
+	s, err := windows.OpenService(m, name, windows.SERVICE_QUERY_STATUS)
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer windows.CloseServiceHandle(s)
+	var status windows.SERVICE_STATUS
+	if err := windows.QueryServiceStatus(s, &status); err != nil {
+		return false, err
+	}
+	return status.CurrentState != windows.SERVICE_STOPPED, nil
 }
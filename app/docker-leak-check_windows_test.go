@@ -0,0 +1,40 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteEntryJunction(t *testing.T) {
+	dir := t.TempDir()
+	rawLayerFolder := filepath.Join(dir, "windowsfilter")
+	target := filepath.Join(dir, "relocated")
+	if err := os.MkdirAll(rawLayerFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(target, "Files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(target, "Files", "content.txt")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	junction := filepath.Join(rawLayerFolder, "junction")
+	if out, err := exec.Command("cmd", "/c", "mklink", "/J", junction, target).CombinedOutput(); err != nil {
+		t.Skipf("failed to create junction: %v: %s", err, out)
+	}
+
+	if err := deleteEntry(removal{folder: rawLayerFolder, layer: "junction", kind: "windowsfilter"}); err != nil {
+		t.Fatalf("deleteEntry() error = %v", err)
+	}
+	if _, err := os.Lstat(junction); !os.IsNotExist(err) {
+		t.Errorf("junction still exists after deleteEntry(): %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("target of the junction was modified by deleteEntry(): %v", err)
+	}
+}
@@ -2,7 +2,10 @@ module docker-leak-check
 
 go 1.18
 
-require github.com/Microsoft/hcsshim v0.9.3
+require (
+	github.com/Microsoft/hcsshim v0.9.3
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+)
 
 require (
 	github.com/Microsoft/go-winio v0.4.17 // indirect
@@ -12,5 +15,4 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	go.opencensus.io v0.22.3 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
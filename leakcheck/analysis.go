@@ -0,0 +1,438 @@
+package leakcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImportCluster is a chain of unreferenced layers that were most likely left behind by an interrupted import.
+type ImportCluster struct {
+	Layers []string
+	Oldest time.Time
+	Newest time.Time
+}
+
+// FindFailedImports groups unreferenced layerDB entries whose on-disk layer is unreferenced as well by following
+// their parent links. An interrupted 'docker load' typically leaves exactly such a contiguous chain behind.
+func (s *Scanner) FindFailedImports(layerDBFolder string, unreferencedLayers, unreferencedRawLayers []string) ([]ImportCluster, error) {
+	const shaPrefix = "sha256:"
+	orphanedRaw := make(map[string]struct{})
+	for _, layer := range unreferencedRawLayers {
+		orphanedRaw[layer] = struct{}{}
+	}
+
+	parents := make(map[string]string)
+	modTimes := make(map[string]time.Time)
+	for _, layer := range unreferencedLayers {
+		cacheIDFile := filepath.Join(layerDBFolder, layer, "cache-id")
+		dat, err := s.FS.ReadFile(cacheIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to read file %s: %v", cacheIDFile, err)
+		}
+		if _, found := orphanedRaw[strings.TrimSpace(string(dat))]; !found {
+			continue
+		}
+		info, err := s.FS.Stat(filepath.Join(layerDBFolder, layer))
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to stat %s: %v", filepath.Join(layerDBFolder, layer), err)
+		}
+		modTimes[layer] = info.ModTime()
+		// base layers don't have a parent file
+		dat, err = s.FS.ReadFile(filepath.Join(layerDBFolder, layer, "parent"))
+		if err == nil {
+			parents[layer] = strings.TrimPrefix(strings.TrimSpace(string(dat)), shaPrefix)
+		} else {
+			parents[layer] = ""
+		}
+	}
+
+	clusterOf := make(map[string]*ImportCluster)
+	var clusters []*ImportCluster
+	for layer := range parents {
+		// walk up to the topmost parent that is still part of the leak
+		root := layer
+		seen := map[string]struct{}{root: {}}
+		for {
+			parent := parents[root]
+			if _, candidate := parents[parent]; !candidate {
+				break
+			}
+			if _, loop := seen[parent]; loop {
+				break
+			}
+			seen[parent] = struct{}{}
+			root = parent
+		}
+		c, exists := clusterOf[root]
+		if !exists {
+			c = &ImportCluster{Oldest: modTimes[layer], Newest: modTimes[layer]}
+			clusterOf[root] = c
+			clusters = append(clusters, c)
+		}
+		c.Layers = append(c.Layers, layer)
+		if modTimes[layer].Before(c.Oldest) {
+			c.Oldest = modTimes[layer]
+		}
+		if modTimes[layer].After(c.Newest) {
+			c.Newest = modTimes[layer]
+		}
+	}
+
+	result := make([]ImportCluster, 0, len(clusters))
+	for _, c := range clusters {
+		sort.Slice(c.Layers, func(i, j int) bool { return modTimes[c.Layers[i]].Before(modTimes[c.Layers[j]]) })
+		result = append(result, *c)
+	}
+	// most recent leaks first, these are the most likely ones to show up in the logs
+	sort.Slice(result, func(i, j int) bool { return result[i].Newest.After(result[j].Newest) })
+	return result, nil
+}
+
+// layerSignature is a cheap summary of a layer's contents, used to avoid hashing layers that can't be identical.
+type layerSignature struct {
+	files int
+	size  int64
+}
+
+func computeLayerSignature(path string) (layerSignature, error) {
+	var sig layerSignature
+	err := filepath.Walk(LongPath(path), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			sig.files++
+			sig.size += info.Size()
+		}
+		return nil
+	})
+	return sig, err
+}
+
+// LayerSize sums up the sizes of all files in a layer folder, including its Files folder and virtual disks. Paths that
+// can't be read are skipped and returned, so the size of the readable part is still reported.
+// Files with several hard links inside the folder are counted once.
+func LayerSize(path string) (int64, []string) {
+	w := newSizeWalker(OSFileSystem{})
+	w.walk(context.Background(), path)
+	return w.size, w.skipped
+}
+
+// ReclaimReport summarizes how much space removing the leaks of a Docker runtime root would free.
+type ReclaimReport struct {
+	// Number of unreferenced layerDB entries and on-disk layers, and of orphaned imagedb metadata folders.
+	UnreferencedLayers    int
+	UnreferencedRawLayers int
+	OrphanedMetadata      int
+	// Total size of the unreferenced on-disk layers in bytes, without the files that are hard linked from outside of
+	// them, as removing the layers doesn't free those.
+	ReclaimableBytes int64
+	// Size of the files in the unreferenced on-disk layers that are hard linked from outside of them.
+	SharedBytes int64
+	// Approximate is set if the file system doesn't expose whether files share their storage with other files, so
+	// ReclaimableBytes may include shared bytes. This is always the case on Windows, where block clones on ReFS can't
+	// be detected.
+	Approximate bool
+	// Paths whose size could not be determined, ReclaimableBytes only covers the readable part of the layers.
+	SkippedPaths []string
+}
+
+// EstimateReclaimable scans a Docker runtime root and sums up the sizes of its unreferenced on-disk layers, without
+// removing or printing anything. Like Scan, it stops once ctx is done.
+func (s *Scanner) EstimateReclaimable(ctx context.Context, root string) (ReclaimReport, error) {
+	result, err := s.Scan(ctx, root)
+	if err != nil {
+		return ReclaimReport{}, err
+	}
+	report := ReclaimReport{
+		UnreferencedLayers:    len(result.UnreferencedLayers),
+		UnreferencedRawLayers: len(result.UnreferencedRawLayers),
+		OrphanedMetadata:      len(result.OrphanedMetadata),
+	}
+	rawLayerFolder := s.Folders(root).RawLayer
+	// a single walk over all layers, so files hard linked between the unreferenced layers count as reclaimable
+	w := newSizeWalker(s.FS)
+	for _, layer := range result.UnreferencedRawLayers {
+		if err := w.walk(ctx, filepath.Join(rawLayerFolder, layer)); err != nil {
+			return ReclaimReport{}, err
+		}
+	}
+	report.SharedBytes = w.shared()
+	report.ReclaimableBytes = w.size - report.SharedBytes
+	report.Approximate = w.unidentified
+	report.SkippedPaths = w.skipped
+	return report, nil
+}
+
+// fileKey identifies a file across all of its hard links.
+type fileKey struct {
+	device uint64
+	index  uint64
+}
+
+// linkedFile is a file with several hard links, along with how many of them were walked.
+type linkedFile struct {
+	size  int64
+	links uint64
+	seen  uint64
+}
+
+// sizeWalker sums up the sizes of all regular files in layer folders read through a file system. Files with several
+// hard links are counted once, no matter how many of the walked folders link them.
+type sizeWalker struct {
+	fsys    FileSystem
+	size    int64
+	skipped []string
+	linked  map[fileKey]*linkedFile
+	// Some files could not be identified, so they may share their storage with other files.
+	unidentified bool
+}
+
+func newSizeWalker(fsys FileSystem) *sizeWalker {
+	return &sizeWalker{fsys: fsys, linked: make(map[fileKey]*linkedFile)}
+}
+
+// shared returns the size of the walked files that have hard links outside of the walked folders.
+func (w *sizeWalker) shared() int64 {
+	var shared int64
+	for _, f := range w.linked {
+		if f.seen < f.links {
+			shared += f.size
+		}
+	}
+	return shared
+}
+
+// walk adds the sizes of the files in a layer folder, or of path itself if it is a file. Links are not followed below
+// path. Paths that can't be read are skipped. The walk stops once ctx is done.
+func (w *sizeWalker) walk(ctx context.Context, path string) error {
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	entries, err := w.fsys.ReadDir(path)
+	if err != nil && len(entries) == 0 {
+		// removals of dangling images target the files of the imagedb rather than folders
+		if info, statErr := w.fsys.Stat(path); statErr == nil && info.Mode().IsRegular() {
+			w.addFile(info)
+			return nil
+		}
+		w.skipped = append(w.skipped, path)
+		return nil
+	}
+	if err != nil {
+		w.skipped = append(w.skipped, path)
+	}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		if e.IsDir() {
+			if err := w.walk(ctx, p); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			w.skipped = append(w.skipped, p)
+			continue
+		}
+		if info.Mode().IsRegular() {
+			w.addFile(info)
+		}
+	}
+	return nil
+}
+
+func (w *sizeWalker) addFile(info fs.FileInfo) {
+	key, links, ok := fileIdentity(info)
+	if !ok {
+		w.unidentified = true
+		w.size += info.Size()
+		return
+	}
+	if links <= 1 {
+		w.size += info.Size()
+		return
+	}
+	f, found := w.linked[key]
+	if !found {
+		f = &linkedFile{size: info.Size(), links: links}
+		w.linked[key] = f
+		w.size += info.Size()
+	}
+	f.seen++
+}
+
+// NewestModTime returns the most recent modification time of a layer folder and everything inside of it.
+func NewestModTime(path string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.Walk(LongPath(path), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error: failed to determine modification time of %s: %v", path, err)
+	}
+	return newest, nil
+}
+
+// HashLayer computes a sha256 over the relative paths and contents of all files in a layer folder. Identical layers
+// have the same hash, regardless of their name or the host they are on.
+func HashLayer(path string) (string, error) {
+	h := sha256.New()
+	root := LongPath(path)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, filepath.ToSlash(rel))
+		h.Write([]byte{0})
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error: failed to hash layer %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindDuplicateLayers returns a map of unreferenced on-disk layers whose contents are identical to a referenced layer,
+// to the ID of that referenced layer. Only layers with a matching signature are hashed. The contents of the layers are
+// read from the disk, so this doesn't work for archives.
+func (s *Scanner) FindDuplicateLayers(rawLayerFolder string, unreferencedRawLayers []string) (map[string]string, error) {
+	unreferenced := make(map[string]struct{})
+	for _, layer := range unreferencedRawLayers {
+		unreferenced[layer] = struct{}{}
+	}
+
+	orphansBySignature := make(map[layerSignature][]string)
+	for _, layer := range unreferencedRawLayers {
+		sig, err := computeLayerSignature(filepath.Join(rawLayerFolder, layer))
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to read layer %s: %v", layer, err)
+		}
+		orphansBySignature[sig] = append(orphansBySignature[sig], layer)
+	}
+
+	files, err := s.FS.ReadDir(rawLayerFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", rawLayerFolder, err)
+	}
+	duplicates := make(map[string]string)
+	orphanHashes := make(map[string]string)
+	for _, f := range files {
+		if _, orphan := unreferenced[f.Name()]; orphan || !f.IsDir() {
+			continue
+		}
+		referencedPath := filepath.Join(rawLayerFolder, f.Name())
+		sig, err := computeLayerSignature(referencedPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to read layer %s: %v", f.Name(), err)
+		}
+		candidates := orphansBySignature[sig]
+		if len(candidates) == 0 {
+			continue
+		}
+		referencedHash, err := HashLayer(referencedPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, orphan := range candidates {
+			if _, done := duplicates[orphan]; done {
+				continue
+			}
+			orphanHash, hashed := orphanHashes[orphan]
+			if !hashed {
+				orphanHash, err = HashLayer(filepath.Join(rawLayerFolder, orphan))
+				if err != nil {
+					return nil, err
+				}
+				orphanHashes[orphan] = orphanHash
+			}
+			if orphanHash == referencedHash {
+				duplicates[orphan] = f.Name()
+			}
+		}
+	}
+	return duplicates, nil
+}
+
+// newHasher returns the hash function for the algorithm part of a digest such as "sha256:<hex>".
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+}
+
+// verifyDigest checks that the contents of a file match a digest of the form "<algorithm>:<hex>".
+func verifyDigest(fsys FileSystem, path, digest string) error {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed digest %q", digest)
+	}
+	h, err := newHasher(parts[0])
+	if err != nil {
+		return err
+	}
+	// image configs are small enough to be read at once
+	dat, err := fsys.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	h.Write(dat)
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != parts[1] {
+		return fmt.Errorf("content of %s has digest %s:%s, expected %s", path, parts[0], actual, digest)
+	}
+	return nil
+}
+
+// VerifyImageDigests checks that every image config in the imagedb matches the digest it is named after. The digest
+// algorithm is taken from the name of the content folder, e.g. imagedb/content/sha256.
+func (s *Scanner) VerifyImageDigests(imageDBFolder string) ([]string, error) {
+	files, err := s.FS.ReadDir(imageDBFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", imageDBFolder, err)
+	}
+	algorithm := filepath.Base(imageDBFolder)
+	var corrupt []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := verifyDigest(s.FS, filepath.Join(imageDBFolder, f.Name()), algorithm+":"+f.Name()); err != nil {
+			corrupt = append(corrupt, err.Error())
+		}
+	}
+	return corrupt, nil
+}
@@ -0,0 +1,135 @@
+package leakcheck
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestEstimateReclaimable(t *testing.T) {
+	f := newFixture()
+	f.image("app:latest", digest("base"))
+	f.layer("", digest("removed"), "leaked")
+	f.rawLayer("rawonly")
+	f.fs.write(filepath.Join(f.folders.RawLayer, "rawonly", "diff", "etc", "config"), "0123456789")
+	f.fs.mkdir(filepath.Join(f.folders.ImageMetaData, "deadbeef"))
+
+	report, err := f.scanner().EstimateReclaimable(context.Background(), f.folders.Root)
+	if err != nil {
+		t.Fatalf("EstimateReclaimable() error = %v", err)
+	}
+	want := ReclaimReport{UnreferencedLayers: 1, UnreferencedRawLayers: 2, OrphanedMetadata: 1, ReclaimableBytes: 2*int64(len("content")) + 10}
+	if report.UnreferencedLayers != want.UnreferencedLayers || report.UnreferencedRawLayers != want.UnreferencedRawLayers ||
+		report.OrphanedMetadata != want.OrphanedMetadata || report.ReclaimableBytes != want.ReclaimableBytes || len(report.SkippedPaths) != 0 {
+		t.Errorf("EstimateReclaimable() = %+v, expected %+v", report, want)
+	}
+	// the in-memory file system doesn't expose hard links
+	if !report.Approximate {
+		t.Errorf("EstimateReclaimable() is exact, expected it to be approximate without file identities")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.scanner().EstimateReclaimable(ctx, f.folders.Root); !errors.Is(err, context.Canceled) {
+		t.Errorf("EstimateReclaimable() error = %v with a canceled context, expected %v", err, context.Canceled)
+	}
+}
+
+func TestHashLayer(t *testing.T) {
+	dir := t.TempDir()
+	write := func(layer, content string) string {
+		path := filepath.Join(dir, layer)
+		if err := os.MkdirAll(filepath.Join(path, "diff", "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "diff", "etc", "config"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := HashLayer(path)
+		if err != nil {
+			t.Fatalf("HashLayer(%s) error = %v", layer, err)
+		}
+		return hash
+	}
+
+	// clones of a host leak the same layer under a different cache-id
+	first, clone, other := write("first", "content"), write("clone", "content"), write("other", "changed")
+	if first != clone {
+		t.Errorf("HashLayer() = %s and %s for identical layers, expected the same hash", first, clone)
+	}
+	if first == other {
+		t.Errorf("HashLayer() = %s for layers with different contents", first)
+	}
+}
+
+func TestLayerSize(t *testing.T) {
+	dir := t.TempDir()
+	layer := filepath.Join(dir, "layer")
+	for path, content := range map[string]string{"diff/etc/config": "0123456789", "diff/file": "content", "diff/empty": ""} {
+		path = filepath.Join(layer, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size, skipped := LayerSize(layer); size != 17 || len(skipped) != 0 {
+		t.Errorf("LayerSize(folder) = %d, %v, expected 17", size, skipped)
+	}
+	if size, skipped := LayerSize(filepath.Join(layer, "diff", "file")); size != 7 || len(skipped) != 0 {
+		t.Errorf("LayerSize(file) = %d, %v, expected 7", size, skipped)
+	}
+	missing := filepath.Join(dir, "missing")
+	if size, skipped := LayerSize(missing); size != 0 || len(skipped) != 1 || skipped[0] != missing {
+		t.Errorf("LayerSize(missing) = %d, %v, expected %s to be skipped", size, skipped, missing)
+	}
+}
+
+func TestSizeWalkerHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links can't be identified on Windows")
+	}
+	dir := t.TempDir()
+	write := func(path, content string) string {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	link := func(target, path string) {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a/config is linked twice within the layer, b/shared is also linked from a referenced layer
+	link(write("a/config", "0123456789"), "a/config-link")
+	link(write("b/shared", "01234"), "used/shared")
+	write("b/own", "012")
+
+	if size, skipped := LayerSize(filepath.Join(dir, "a")); size != 10 || len(skipped) != 0 {
+		t.Errorf("LayerSize() = %d, %v, expected hard links to be counted once", size, skipped)
+	}
+
+	w := newSizeWalker(OSFileSystem{})
+	for _, layer := range []string{"a", "b"} {
+		if err := w.walk(context.Background(), filepath.Join(dir, layer)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.size != 18 || w.shared() != 5 || w.unidentified {
+		t.Errorf("walk() = size %d, shared %d, unidentified %v, expected 18, 5, false", w.size, w.shared(), w.unidentified)
+	}
+}
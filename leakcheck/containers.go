@@ -0,0 +1,183 @@
+package leakcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// hostConfigType holds the parts of a container's hostconfig.json that may refer to storage on the host.
+type hostConfigType struct {
+	Binds  []string `json:"Binds,omitempty"`
+	Mounts []struct {
+		Source string `json:"Source"`
+	} `json:"Mounts,omitempty"`
+}
+
+// layerOfPath returns the name of the on-disk layer that the given host path lives in, or an empty string if the path
+// is not located inside the raw layer folder.
+func layerOfPath(rawLayerFolder, path string) string {
+	prefix := strings.ToLower(filepath.Clean(rawLayerFolder)) + string(filepath.Separator)
+	if !strings.HasPrefix(strings.ToLower(path), prefix) {
+		return ""
+	}
+	rest := path[len(prefix):]
+	if i := strings.IndexAny(rest, `\/:`); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// visitHostConfigLayers marks on-disk layers that are referenced by the binds and mounts of a container as visited.
+// Not all containers have a hostconfig.json, nor do all of them fill in every field, hence missing data is not an error.
+func (s *Scanner) visitHostConfigLayers(hostConfigFile, rawLayerFolder string, rawLayerMap map[string]*rawLayerType) {
+	dat, err := s.FS.ReadFile(hostConfigFile)
+	if err != nil {
+		return
+	}
+	hostConfig := &hostConfigType{}
+	if err := json.Unmarshal(dat, hostConfig); err != nil {
+		s.logf("WARN: Failed to read JSON contents of %s: %v\n", hostConfigFile, err)
+		return
+	}
+	sources := hostConfig.Binds
+	for _, m := range hostConfig.Mounts {
+		sources = append(sources, m.Source)
+	}
+	for _, source := range sources {
+		if layer := rawLayerMap[layerOfPath(rawLayerFolder, source)]; layer != nil {
+			layer.visited = true
+			layer.visitedByContainer = true
+			s.debugf(2, "Marking on-disk layer %s as used by mount %s in %s\n", layer.ID, source, hostConfigFile)
+		}
+	}
+}
+
+// containerConfigType holds the parts of a container's config.v2.json that refer to its image and storage.
+type containerConfigType struct {
+	Image       string `json:"Image"`
+	GraphDriver struct {
+		Name string            `json:"Name"`
+		Data map[string]string `json:"Data"`
+	} `json:"GraphDriver"`
+}
+
+// graphDriverLayer returns the name of the on-disk layer a path recorded by the storage driver points to, i.e. the
+// path element following the driver folder. The daemon records absolute paths, which may differ from the scanned root,
+// e.g. when checking a copy of it.
+func graphDriverLayer(path, driver string) string {
+	elements := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' })
+	for i := len(elements) - 2; i >= 0; i-- {
+		if strings.EqualFold(elements[i], driver) {
+			return elements[i+1]
+		}
+	}
+	return ""
+}
+
+// visitGraphDriverLayers marks the read-write and init layers recorded in the GraphDriver data of a container's
+// config.v2.json as visited. The lower layers of overlay2 belong to the image, except for the init layer.
+func (s *Scanner) visitGraphDriverLayers(configFile string, rawLayerMap map[string]*rawLayerType) {
+	dat, err := s.FS.ReadFile(configFile)
+	if err != nil {
+		return
+	}
+	config := &containerConfigType{}
+	if err := json.Unmarshal(dat, config); err != nil {
+		s.logf("WARN: Failed to read JSON contents of %s: %v\n", configFile, err)
+		return
+	}
+	if config.GraphDriver.Name != "" && config.GraphDriver.Name != s.Driver {
+		return
+	}
+	var paths []string
+	for key, value := range config.GraphDriver.Data {
+		if key != "LowerDir" {
+			paths = append(paths, value)
+			continue
+		}
+		for _, lower := range strings.Split(value, ":") {
+			if strings.HasSuffix(graphDriverLayer(lower, s.Driver), "-init") {
+				paths = append(paths, lower)
+			}
+		}
+	}
+	for _, path := range paths {
+		if layer := rawLayerMap[graphDriverLayer(path, s.Driver)]; layer != nil && !layer.visitedByContainer {
+			layer.visited = true
+			layer.visitedByContainer = true
+			s.debugf(2, "Marking on-disk layer %s as used by the GraphDriver data in %s\n", layer.ID, configFile)
+		}
+	}
+}
+
+// ContainerImages returns the images that are used by a container, without their sha256: prefix.
+func (s *Scanner) ContainerImages(containerFolder string) (map[string]struct{}, error) {
+	files, err := s.FS.ReadDir(containerFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", containerFolder, err)
+	}
+	images := make(map[string]struct{})
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		configFile := filepath.Join(containerFolder, f.Name(), "config.v2.json")
+		dat, err := s.FS.ReadFile(configFile)
+		if err != nil {
+			continue
+		}
+		config := &containerConfigType{}
+		if err := json.Unmarshal(dat, config); err != nil {
+			s.logf("WARN: Failed to read JSON contents of %s: %v\n", configFile, err)
+			continue
+		}
+		if config.Image != "" {
+			images[strings.TrimPrefix(config.Image, "sha256:")] = struct{}{}
+		}
+	}
+	return images, nil
+}
+
+// visitMountLayers marks the read-write and init layers of a container, as recorded in its layerdb mounts entry, as
+// visited. Their names differ from the container id, so they would otherwise be taken for leaks.
+func (s *Scanner) visitMountLayers(mountFolder string, rawLayerMap map[string]*rawLayerType) {
+	for _, name := range []string{"mount-id", "init-id"} {
+		dat, err := s.FS.ReadFile(filepath.Join(mountFolder, name))
+		if err != nil {
+			// init-id is optional, and containers created by older versions of Docker have no mounts entry
+			continue
+		}
+		if layer := rawLayerMap[strings.TrimSpace(string(dat))]; layer != nil {
+			layer.visited = true
+			layer.visitedByContainer = true
+			s.debugf(2, "Marking on-disk layer %s as used by the %s of container %s\n", layer.ID, name, filepath.Base(mountFolder))
+		}
+	}
+}
+
+func (s *Scanner) visitContainerLayers(ctx context.Context, containerFolder, mountsFolder, rawLayerFolder string, rawLayerMap map[string]*rawLayerType) error {
+	files, err := s.FS.ReadDir(containerFolder)
+	if err != nil {
+		return fmt.Errorf("Error: failed to read files in %s: %v", containerFolder, err)
+	}
+	for _, f := range files {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		if f.IsDir() {
+			layer := rawLayerMap[f.Name()]
+			if layer != nil {
+				layer.visited = true
+				layer.visitedByContainer = true
+				s.debugf(2, "Marking on-disk layer %s as used by container %s\n", layer.ID, f.Name())
+			}
+			s.visitMountLayers(filepath.Join(mountsFolder, f.Name()), rawLayerMap)
+			s.visitGraphDriverLayers(filepath.Join(containerFolder, f.Name(), "config.v2.json"), rawLayerMap)
+			s.visitHostConfigLayers(filepath.Join(containerFolder, f.Name(), "hostconfig.json"), rawLayerFolder, rawLayerMap)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package leakcheck
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned by the scanner, wrapped so errors.Is can be used to tell the kinds of failures apart.
+var (
+	// ErrFolderMissing means the Docker runtime root doesn't exist.
+	ErrFolderMissing = errors.New("folder does not exist")
+	// ErrBadLayout means the root lacks some of the folders or files of the expected layout.
+	ErrBadLayout = errors.New("incorrect folder structure")
+	// ErrAccess means a path exists, but could not be accessed, e.g. due to missing permissions.
+	ErrAccess = errors.New("failed to access path")
+)
+
+// sentinelError carries the message shown to the user, while unwrapping to one of the sentinel errors, so the messages
+// stay the same as before they were introduced.
+type sentinelError struct {
+	msg      string
+	sentinel error
+}
+
+func (e *sentinelError) Error() string {
+	return e.msg
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.sentinel
+}
+
+func sentinelf(sentinel error, format string, a ...interface{}) error {
+	return &sentinelError{msg: fmt.Sprintf(format, a...), sentinel: sentinel}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package leakcheck
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file along with its number of hard links. ok is false if the file
+// system doesn't expose them, e.g. for archives.
+func fileIdentity(info fs.FileInfo) (key fileKey, links uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, 0, false
+	}
+	return fileKey{device: uint64(st.Dev), index: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -0,0 +1,160 @@
+package leakcheck
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Folders holds the locations of the parts of a Docker runtime root that are inspected for a storage driver.
+type Folders struct {
+	Root   string
+	Driver string
+	// Layout is the name of the folder below image/ holding the image and layer metadata. It usually matches the
+	// driver, but differs between engine versions for some drivers.
+	Layout        string
+	ImageDB       string
+	LayerDB       string
+	Mounts        string
+	RawLayer      string
+	Container     string
+	RepoJson      string
+	ImageMetaData string
+}
+
+// NewFolders returns the folders of a root whose metadata layout is named after the driver.
+func NewFolders(root, driver string) Folders {
+	return newFoldersWithLayout(root, driver, driver)
+}
+
+func newFoldersWithLayout(root, driver, layout string) Folders {
+	return Folders{
+		Root:          root,
+		Driver:        driver,
+		Layout:        layout,
+		ImageDB:       filepath.Join(root, "image", layout, "imagedb", "content", "sha256"),
+		LayerDB:       filepath.Join(root, "image", layout, "layerdb", "sha256"),
+		Mounts:        filepath.Join(root, "image", layout, "layerdb", "mounts"),
+		RawLayer:      filepath.Join(root, driver),
+		Container:     filepath.Join(root, "containers"),
+		RepoJson:      filepath.Join(root, "image", layout, "repositories.json"),
+		ImageMetaData: filepath.Join(root, "image", layout, "imagedb", "metadata", "sha256"),
+	}
+}
+
+// layoutNames are the names of the metadata folder below image/ that engine versions used for a driver, preferred
+// first. Drivers that are not listed only use their own name.
+var layoutNames = map[string][]string{
+	"windowsfilter": {"windowsfilter", "windows"},
+}
+
+// DetectFolders returns the folders of a root, using the first metadata layout of the driver that is present. If none
+// is, the folders of the default layout are returned along with false.
+func DetectFolders(root, driver string) (Folders, bool) {
+	return detectFolders(OSFileSystem{}, root, driver)
+}
+
+func detectFolders(fsys FileSystem, root, driver string) (Folders, bool) {
+	candidates := layoutNames[driver]
+	if len(candidates) == 0 {
+		candidates = []string{driver}
+	}
+	for _, layout := range candidates {
+		if exists(fsys, filepath.Join(root, "image", layout, "layerdb")) {
+			return newFoldersWithLayout(root, driver, layout), true
+		}
+	}
+	return NewFolders(root, driver), false
+}
+
+// layoutError describes which metadata layouts were expected for the driver and which ones exist instead.
+func layoutError(fsys FileSystem, root, driver string) string {
+	candidates := layoutNames[driver]
+	if len(candidates) == 0 {
+		candidates = []string{driver}
+	}
+	var found []string
+	entries, _ := fsys.ReadDir(filepath.Join(root, "image"))
+	for _, e := range entries {
+		if e.IsDir() {
+			found = append(found, e.Name())
+		}
+	}
+	if len(found) == 0 {
+		found = []string{"none"}
+	}
+	return fmt.Sprintf("Error: no metadata layout for driver %s found in %s, expected one of image/{%s}, found: %s",
+		driver, absPath(filepath.Join(root, "image")), strings.Join(candidates, ","), strings.Join(found, ", "))
+}
+
+// ImageOS returns the operating system of the images whose layers are managed by the storage driver.
+func (f Folders) ImageOS() string {
+	if f.Driver == "windowsfilter" {
+		return "windows"
+	}
+	return "linux"
+}
+
+// StructureErrors checks the whole folder structure at once, so all problems can be reported together. The first
+// line names the resolved root and driver, the following ones every missing or inaccessible path.
+func (f Folders) StructureErrors() []string {
+	return f.withHeader(f.structureErrors(OSFileSystem{}))
+}
+
+// structureErrors returns every missing or inaccessible path, without the header.
+func (f Folders) structureErrors(fsys FileSystem) []string {
+	var errs []string
+	for _, folder := range []string{f.ImageDB, f.ImageMetaData, f.LayerDB, f.RawLayer, f.Container} {
+		if found, err := stat(fsys, folder); err != nil {
+			errs = append(errs, err.Error())
+		} else if !found {
+			errs = append(errs, fmt.Sprintf("Error: incorrect folder structure: expected %s to exist", absPath(folder)))
+		}
+	}
+	if found, err := stat(fsys, f.RepoJson); err != nil {
+		errs = append(errs, err.Error())
+	} else if !found {
+		errs = append(errs, fmt.Sprintf("Error: repositories.json not found! Expected %s to exist.", absPath(f.RepoJson)))
+	}
+	return errs
+}
+
+// withHeader prepends the header naming the resolved root, the driver and the number of problems to a list of
+// problems with the folder structure.
+func (f Folders) withHeader(errs []string) []string {
+	if len(errs) == 0 {
+		return errs
+	}
+	header := fmt.Sprintf("Error: %d problems with the layout of Docker runtime root %s for driver %s:", len(errs), absPath(f.Root), f.Driver)
+	return append([]string{header}, errs...)
+}
+
+// absPath returns the absolute form of a path for messages, or the path itself if it can't be resolved.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// DefaultFolder and DefaultDriver return where Docker keeps its data on the current platform by default.
+func DefaultFolder() string {
+	if runtime.GOOS == "windows" {
+		return `C:\programdata\docker`
+	}
+	return "/var/lib/docker"
+}
+
+func DefaultDriver() string {
+	if runtime.GOOS == "windows" {
+		return "windowsfilter"
+	}
+	return "overlay2"
+}
+
+// FolderExists reports whether the path exists. Errors other than 'not exist', e.g. missing permissions, are returned,
+// so they can be reported as such.
+func FolderExists(path string) (bool, error) {
+	return stat(OSFileSystem{}, path)
+}
@@ -0,0 +1,31 @@
+package leakcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanLayoutErrorCount(t *testing.T) {
+	// only a metadata layout of another driver exists, so every folder is missing and the layout can't be detected
+	fsys := newMemFS()
+	fsys.mkdir(filepath.FromSlash("/docker/image/aufs"))
+	s := NewScanner("overlay2")
+	s.FS = fsys
+
+	_, err := s.Scan(context.Background(), filepath.FromSlash("/docker"))
+	if !errors.Is(err, ErrBadLayout) {
+		t.Fatalf("Scan() error = %v, expected %v", err, ErrBadLayout)
+	}
+	lines := strings.Split(err.Error(), "\n")
+	want := fmt.Sprintf("Error: %d problems with the layout", len(lines)-1)
+	if !strings.HasPrefix(lines[0], want) {
+		t.Errorf("Scan() error header = %q, expected it to start with %q", lines[0], want)
+	}
+	if !strings.Contains(lines[len(lines)-1], "no metadata layout for driver overlay2") {
+		t.Errorf("Scan() error = %v, expected it to end with the layout error", err)
+	}
+}
@@ -0,0 +1,68 @@
+package leakcheck
+
+import (
+	"io/fs"
+	"os"
+)
+
+// FileSystem is the subset of file system operations the scanner needs to read the metadata of a Docker runtime root.
+// Paths are regular OS paths, as returned by Folders.
+type FileSystem interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// OSFileSystem reads directly from the disk.
+type OSFileSystem struct{}
+
+// ReadDir returns the entries it was able to read before an error occurred, along with the error.
+func (OSFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(LongPath(name))
+}
+
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(LongPath(name))
+}
+
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(LongPath(name))
+}
+
+// tracingFS logs every directory and file that is read.
+type tracingFS struct {
+	FileSystem
+	s *Scanner
+}
+
+func (t tracingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	t.s.debugf(2, "Reading folder %s\n", name)
+	return t.FileSystem.ReadDir(name)
+}
+
+func (t tracingFS) ReadFile(name string) ([]byte, error) {
+	t.s.debugf(2, "Reading file %s\n", name)
+	return t.FileSystem.ReadFile(name)
+}
+
+// exists reports whether the path exists. Errors other than 'not exist' are taken as existing, so the actual problem
+// surfaces when the path is read.
+func exists(fsys FileSystem, path string) bool {
+	found, err := stat(fsys, path)
+	return found || err != nil
+}
+
+// stat reports whether the path exists. Errors other than 'not exist', e.g. missing permissions, are returned.
+func stat(fsys FileSystem, path string) (bool, error) {
+	_, err := fsys.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if os.IsPermission(err) {
+		return false, sentinelf(ErrAccess, "Error: permission denied accessing %s", path)
+	}
+	return false, sentinelf(ErrAccess, "Error: failed to access %s: %v", path, err)
+}
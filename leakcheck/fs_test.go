@@ -0,0 +1,40 @@
+package leakcheck
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOSFileSystemLongPath(t *testing.T) {
+	// nested folders well beyond the 260 characters of MAX_PATH, as found in deep layer trees
+	dir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		dir = filepath.Join(dir, strings.Repeat(string(rune('a'+i)), 40))
+	}
+	file := filepath.Join(dir, "layer.txt")
+	if len(file) < 300 {
+		t.Fatalf("test path has only %d characters", len(file))
+	}
+	if err := os.MkdirAll(LongPath(dir), 0755); err != nil {
+		t.Fatalf("failed to create %s: %v", dir, err)
+	}
+	if err := os.WriteFile(LongPath(file), []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+
+	fsys := OSFileSystem{}
+	if dat, err := fsys.ReadFile(file); err != nil || string(dat) != "content" {
+		t.Errorf("ReadFile() = %q, %v", dat, err)
+	}
+	if entries, err := fsys.ReadDir(dir); err != nil || len(entries) != 1 || entries[0].Name() != "layer.txt" {
+		t.Errorf("ReadDir() = %v, %v", entries, err)
+	}
+	if found, err := stat(fsys, file); !found || err != nil {
+		t.Errorf("stat() = %v, %v", found, err)
+	}
+	if size, skipped := LayerSize(dir); size != int64(len("content")) || len(skipped) != 0 {
+		t.Errorf("LayerSize() = %d, %v", size, skipped)
+	}
+}
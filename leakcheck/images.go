@@ -0,0 +1,532 @@
+package leakcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type imageType struct {
+	RootFS       *rootFS        `json:"rootfs,omitempty"`
+	OS           string         `json:"os,omitempty"`
+	Architecture string         `json:"architecture,omitempty"`
+	History      []historyEntry `json:"history,omitempty"`
+}
+
+// historyEntry is one step of the build of an image. Steps that only change the config, e.g. ENV or CMD, are marked
+// as empty_layer and have no diff. The other steps correspond to the diff_ids, in order.
+type historyEntry struct {
+	CreatedBy  string `json:"created_by,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// emptyLayerDiff is the diff of a layer without any files, i.e. of an empty tar archive.
+const emptyLayerDiff = "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+
+type rootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids,omitempty"`
+}
+
+// repositories is the layout of repositories.json. The key of the outer map is the image/repo name without tags, the
+// value is another map with full name + tag as key and sha256 as value.
+type repositories struct {
+	Repositories map[string]map[string]string
+}
+
+// LoadImageNames resets the scanner and resolves the names of the images in the given Docker runtime root, both
+// directly from repositories.json and through their inheritance chains.
+func (s *Scanner) LoadImageNames(folders Folders) error {
+	s.reset()
+	return s.populateImageNameDB(folders.RepoJson, folders.ImageMetaData, folders.ImageDB)
+}
+
+func (s *Scanner) populateImageNameDB(reposJson, imageMetadataFolder, imageDBFolder string) error {
+	const shaPrefix = "sha256:"
+	dat, err := s.FS.ReadFile(reposJson)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %v", reposJson, err)
+	}
+	var result repositories
+	if err := json.Unmarshal(dat, &result); err != nil {
+		return fmt.Errorf("failed to unmarshal json of %s: %w", reposJson, err)
+	}
+	// a missing or null key decodes to a nil map, which would silently hide the names of all images
+	if result.Repositories == nil {
+		return fmt.Errorf("%s is missing the Repositories object", reposJson)
+	}
+
+	for _, value := range result.Repositories {
+		for tag, sha := range value {
+			if strings.Contains(tag, "@sha256") {
+				// there are these extra entries that look like a sha for the tag. Not really sure what they are used for.
+				continue
+			}
+			// Need to remove the sha256: prefix from the sha sums still.
+			shaKey := strings.TrimPrefix(sha, shaPrefix)
+			if !exists(s.FS, filepath.Join(imageDBFolder, shaKey)) {
+				// the image was removed without untagging it, the tag can be pruned
+				s.staleTags[tag] = shaKey
+				continue
+			}
+			s.imageNameDB[shaSum(shaKey)] = tag
+		}
+	}
+	if s.SkipInheritance {
+		return nil
+	}
+	// This takes care of the 'top level' images. However, we also have a parent-child relation, where (unnamed) images
+	// are children of one of the 'top level' images. Hence we need to walk the imagesDB folder and follow these relations.
+	files, err := s.FS.ReadDir(imageMetadataFolder)
+	if err != nil {
+		return fmt.Errorf("failed to read files in %s", imageMetadataFolder)
+	}
+
+	childParent := s.imageParentDB
+	for _, d := range files {
+		if d.IsDir() {
+			child := d.Name()
+			if !exists(s.FS, filepath.Join(imageDBFolder, child)) {
+				// orphaned metadata of a removed image, see findOrphanedMetadata
+				continue
+			}
+			// parent id should be stored in a file called 'parent' inside the folder
+			parentFile := filepath.Join(imageMetadataFolder, d.Name(), "parent")
+			dat, err := s.FS.ReadFile(parentFile)
+			if err != nil {
+				s.logln("Error: Unable to read parent info for image id ", child)
+				continue
+			}
+			parent := strings.TrimPrefix(strings.TrimSpace(string(dat)), shaPrefix)
+			childParent[shaSum(child)] = shaSum(parent)
+		}
+	}
+
+	return s.findLeafImages(childParent)
+}
+
+func (s *Scanner) findLeafImages(childParent map[shaSum]shaSum) error {
+	parents := make(map[shaSum]struct{}, len(childParent))
+	for _, parent := range childParent {
+		parents[parent] = struct{}{}
+	}
+	// there are more optimal ways to do this, but should be okay since the number of images will generally be small.
+	for child, parent := range childParent {
+		chain := []shaSum{child, parent}
+		visited := map[shaSum]struct{}{child: {}}
+		for {
+			if _, seen := visited[parent]; seen {
+				// corrupted metadata, the chain would never terminate
+				s.logln("Error: cycle detected in image parent chain of ", child)
+				break
+			}
+			visited[parent] = struct{}{}
+			if s.MaxChainDepth > 0 && len(chain) > s.MaxChainDepth {
+				return fmt.Errorf("Error: inheritance chain of image %s exceeds the maximum depth of %d", child, s.MaxChainDepth)
+			}
+			if val, exists := childParent[parent]; exists {
+				parent = val
+				chain = append(chain, parent)
+				continue
+			} else if leaf, ok := s.imageNameDB[parent]; ok {
+				s.imageNameDB[child] = leaf + " (inheritance chain)"
+				break
+			} else {
+				// dangling image, only the chains starting at the youngest children are kept, the others are part of them
+				s.danglingImages = append(s.danglingImages, parent)
+				if _, isParent := parents[child]; !isParent {
+					s.danglingChains[parent] = append(s.danglingChains[parent], chain)
+				}
+				break
+			}
+		}
+		s.inheritanceChainDB[child] = chain
+	}
+	return nil
+}
+
+// findOrphanedMetadata returns the folders in the imagedb metadata whose image is gone from the imagedb content.
+func (s *Scanner) findOrphanedMetadata(imageMetadataFolder, imageDBFolder string) ([]string, error) {
+	files, err := s.FS.ReadDir(imageMetadataFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", imageMetadataFolder, err)
+	}
+	var orphans []string
+	for _, d := range files {
+		if d.IsDir() && !exists(s.FS, filepath.Join(imageDBFolder, d.Name())) {
+			orphans = append(orphans, d.Name())
+		}
+	}
+	return orphans, nil
+}
+
+// InheritanceChains returns the resolved inheritance chains, from every child image up to the topmost ancestor
+// that could be found.
+func (s *Scanner) InheritanceChains() map[string][]string {
+	chains := make(map[string][]string, len(s.inheritanceChainDB))
+	for child, chain := range s.inheritanceChainDB {
+		links := make([]string, 0, len(chain))
+		for _, sha := range chain {
+			links = append(links, string(sha))
+		}
+		chains[string(child)] = links
+	}
+	return chains
+}
+
+// UntaggedImages returns the images in the imagedb that neither have a name nor are part of an inheritance chain, i.e.
+// that have no parent and are not the parent of another image. Such images are not removed by a regular 'docker rmi'.
+// The images of dangling chains are reported in Result.DanglingImages instead. The inheritance chains are required,
+// hence it fails if SkipInheritance is set.
+func (s *Scanner) UntaggedImages(imageDBFolder string) ([]string, error) {
+	if s.SkipInheritance {
+		return nil, fmt.Errorf("Error: untagged images can't be determined without resolving the inheritance chains")
+	}
+	files, err := s.FS.ReadDir(imageDBFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", imageDBFolder, err)
+	}
+	parents := make(map[shaSum]struct{})
+	for _, parent := range s.imageParentDB {
+		parents[parent] = struct{}{}
+	}
+	var untagged []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		sha := shaSum(f.Name())
+		if _, named := s.imageNameDB[sha]; named {
+			continue
+		}
+		if _, isParent := parents[sha]; isParent {
+			continue
+		}
+		if _, isChild := s.imageParentDB[sha]; isChild {
+			continue
+		}
+		untagged = append(untagged, string(sha))
+	}
+	return untagged, nil
+}
+
+// RemovableImages returns the untagged images that are not used by any container either. These can be removed
+// without affecting named images or containers.
+func (s *Scanner) RemovableImages(folders Folders) ([]string, error) {
+	untagged, err := s.UntaggedImages(folders.ImageDB)
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.ContainerImages(folders.Container)
+	if err != nil {
+		return nil, err
+	}
+	var removable []string
+	for _, sha := range untagged {
+		if _, inUse := used[sha]; !inUse {
+			removable = append(removable, sha)
+		}
+	}
+	return removable, nil
+}
+
+// resolveImage looks up the sha of an image given either by its name or by its (optionally prefixed) sha.
+func (s *Scanner) resolveImage(nameOrSha string) shaSum {
+	sha := shaSum(strings.TrimPrefix(nameOrSha, "sha256:"))
+	if _, found := s.imageNameDB[sha]; found {
+		return sha
+	}
+	for sha, name := range s.imageNameDB {
+		if name == nameOrSha {
+			return sha
+		}
+	}
+	return sha
+}
+
+// ImageConfig summarizes the config of an image.
+type ImageConfig struct {
+	Name         string
+	OS           string
+	Architecture string
+	LayerCount   int
+}
+
+// ImageConfigs returns the config summaries of all images in the imagedb of the last scan, including the ones for
+// another OS, keyed by sha.
+func (s *Scanner) ImageConfigs() map[string]ImageConfig {
+	configs := make(map[string]ImageConfig, len(s.imageConfigDB))
+	for sha, config := range s.imageConfigDB {
+		configs[string(sha)] = config
+	}
+	return configs
+}
+
+// ImageInfo describes the layers of a single image.
+type ImageInfo struct {
+	ID     string
+	Name   string
+	OS     string
+	Layers []LayerInfo
+}
+
+// LayerInfo describes a single layer of an image, from its diff ID down to its on-disk layer.
+type LayerInfo struct {
+	DiffID    string
+	LayerDBID string
+	CacheID   string
+	// Path is the on-disk layer, if it exists.
+	Path   string
+	OnDisk bool
+	Files  int
+	Size   int64
+	// SizeErr is set if the size of the on-disk layer could not be determined.
+	SizeErr error
+}
+
+// Broken reports whether the layerDB entry or the on-disk layer of the layer is missing.
+func (l LayerInfo) Broken() bool {
+	return l.LayerDBID == "" || !l.OnDisk
+}
+
+// InspectImage looks up every layer of a single image, given by name or sha256, along with its layerDB entry,
+// cache-id and on-disk state, including the size of the on-disk layers. The image names have to be loaded beforehand.
+func (s *Scanner) InspectImage(folders Folders, nameOrSha string) (*ImageInfo, error) {
+	return s.inspectImage(folders, nameOrSha, true)
+}
+
+// FindImage looks up the layers of a single image like InspectImage, without walking the on-disk layers to determine
+// their size.
+func (s *Scanner) FindImage(folders Folders, nameOrSha string) (*ImageInfo, error) {
+	return s.inspectImage(folders, nameOrSha, false)
+}
+
+func (s *Scanner) inspectImage(folders Folders, nameOrSha string, sizes bool) (*ImageInfo, error) {
+	sha := s.resolveImage(nameOrSha)
+	imagePath := filepath.Join(folders.ImageDB, string(sha))
+	dat, err := s.FS.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error: image %s not found: %v", nameOrSha, err)
+	}
+	image := &imageType{}
+	if err := json.Unmarshal(dat, image); err != nil {
+		return nil, fmt.Errorf("Error: failed to read JSON contents of %s: %v", imagePath, err)
+	}
+	if image.RootFS == nil {
+		return nil, fmt.Errorf("Error: image %s has no rootfs", nameOrSha)
+	}
+
+	rawLayerMap, err := s.createRawLayerMap(context.Background(), folders.RawLayer)
+	if err != nil {
+		return nil, err
+	}
+	layerMap, err := s.populateLayerDBMap(context.Background(), folders.LayerDB)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ImageInfo{ID: string(sha), Name: s.imageNameDB[sha], OS: image.OS}
+	for _, diff := range image.RootFS.DiffIDs {
+		layerInfo := LayerInfo{DiffID: diff}
+		if layers := layerMap[diff]; len(layers) != 0 {
+			layer := layers[0]
+			layerInfo.LayerDBID = layer.ID
+			layerInfo.CacheID = layer.cacheID
+			if rawLayerMap[layer.cacheID] != nil {
+				layerInfo.OnDisk = true
+				layerInfo.Path = filepath.Join(folders.RawLayer, layer.cacheID)
+				if sizes {
+					sig, err := computeLayerSignature(layerInfo.Path)
+					layerInfo.Files, layerInfo.Size, layerInfo.SizeErr = sig.files, sig.size, err
+				}
+			}
+		}
+		info.Layers = append(info.Layers, layerInfo)
+	}
+	return info, nil
+}
+
+// isDigest reports whether s is a sha256 digest as used for diff IDs, i.e. sha256: followed by 64 lowercase hex digits.
+func isDigest(s string) bool {
+	hex := strings.TrimPrefix(s, "sha256:")
+	if len(hex) != 64 || len(s) == len(hex) {
+		return false
+	}
+	for _, c := range hex {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// excludedImage returns the first of ExcludeImages that matches the resolved name of the image. Children named through
+// their inheritance chain are matched by the name of the chain.
+func (s *Scanner) excludedImage(sha shaSum) (string, bool) {
+	name, found := s.imageNameDB[sha]
+	if !found {
+		return "", false
+	}
+	name = strings.TrimSuffix(name, " (inheritance chain)")
+	for _, pattern := range s.ExcludeImages {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// explainHistory logs which steps of the build of an image didn't produce a layer and which diffs are empty, so they
+// aren't mistaken for missing layers.
+func (s *Scanner) explainHistory(sha shaSum, image *imageType) {
+	if s.Verbosity < 1 || image.RootFS == nil {
+		return
+	}
+	diffIDs := image.RootFS.DiffIDs
+	layers := 0
+	for i, entry := range image.History {
+		if entry.EmptyLayer {
+			s.debugf(1, "Image %s: history entry %d has no layer (empty_layer): %s\n", sha, i, entry.CreatedBy)
+			continue
+		}
+		if layers < len(diffIDs) && diffIDs[layers] == emptyLayerDiff {
+			s.debugf(1, "Image %s: diff %s of history entry %d is an empty layer: %s\n", sha, emptyLayerDiff, i, entry.CreatedBy)
+		}
+		layers++
+	}
+	if len(image.History) != 0 && layers != len(diffIDs) {
+		s.debugf(1, "Image %s: history has %d entries with a layer, but there are %d diffs\n", sha, layers, len(diffIDs))
+	}
+}
+
+func (s *Scanner) verifyLayersOfImage(ctx context.Context, imagePath string, sha shaSum, layerMap map[string][]*layerDBItem, rawLayerMap map[string]*rawLayerType, layerDBFolder, imageOS string) error {
+	dat, err := s.FS.ReadFile(imagePath)
+	if err != nil {
+		return fmt.Errorf("Error: failed to read file %s: %v", imagePath, err)
+	}
+	image := &imageType{}
+	if err := json.Unmarshal(dat, image); err != nil {
+		return fmt.Errorf("Error: failed to read JSON contents of %s: %v", imagePath, err)
+	}
+	config := ImageConfig{Name: s.imageNameDB[sha], OS: image.OS, Architecture: image.Architecture}
+	if image.RootFS != nil {
+		config.LayerCount = len(image.RootFS.DiffIDs)
+	}
+	s.imageConfigDB[sha] = config
+
+	// the layers of images for another OS are managed by a different storage driver. Images without an OS or with an
+	// unknown one can't be attributed to the driver either, matching their diffs could mark the wrong layers as used.
+	if image.OS != imageOS {
+		s.debugf(2, "Skipping image %s with OS %q\n", imagePath, image.OS)
+		s.otherOSImages[image.OS] = append(s.otherOSImages[image.OS], sha)
+		return nil
+	}
+
+	if pattern, excluded := s.excludedImage(sha); excluded {
+		s.logf("Info: Excluding image %s (%s) matching %s\n", s.imageNameDB[sha], sha, pattern)
+		return nil
+	}
+
+	// without a rootfs, the layers of the image can't be told apart from leaks
+	if image.RootFS == nil {
+		return fmt.Errorf("Error: image %s has no rootfs in %s", sha, imagePath)
+	}
+
+	// a malformed diff would never match a layerDB entry, making the layers of the image look like leaks
+	for i, diff := range image.RootFS.DiffIDs {
+		if !isDigest(diff) {
+			return fmt.Errorf("Error: image %s has malformed diff ID %q at position %d, expected sha256: followed by 64 hex digits", sha, diff, i)
+		}
+	}
+
+	s.explainHistory(sha, image)
+
+	if s.Strict {
+		if err := verifyLayerOrdering(s.FS, layerDBFolder, image.RootFS.DiffIDs); err != nil {
+			s.logf("Error: Inconsistent layer ordering in image %s: %v\n", sha, err)
+			s.inconsistentImages = append(s.inconsistentImages, sha)
+		}
+	}
+
+	for _, diff := range image.RootFS.DiffIDs {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		layers := layerMap[diff]
+		if len(layers) == 0 && len(s.unreadableLayerDB) != 0 {
+			// the layer may be one of the entries that couldn't be read
+			s.logf("WARN: No readable layerDB entry for diff %s of image %s\n", diff, sha)
+			continue
+		}
+		if len(layers) == 0 {
+			return fmt.Errorf("Error: expected layer with diff %s", diff)
+		}
+		// identical layers, e.g. empty ones, share their diff, so every layerDB entry with this diff is taken as used
+		onDisk := false
+		for _, layer := range layers {
+			s.debugf(1, "Image %s: diff %s resolves to layerDB entry %s, on-disk layer %s\n", sha, diff, layer.ID, layer.cacheID)
+			if rawLayer := rawLayerMap[layer.cacheID]; rawLayer != nil {
+				rawLayer.visited = true
+				rawLayer.visitedByImage = true
+				onDisk = true
+				s.debugf(2, "Marking on-disk layer %s as used by image %s\n", rawLayer.ID, sha)
+			}
+			layer.visited = true
+			s.layerDiffs[layer.ID] = shaSum(diff)
+			s.debugf(2, "Marking layerDB entry %s as used by image %s\n", layer.ID, sha)
+		}
+		if !onDisk {
+			return fmt.Errorf("Error: expected on-disk layer %s\n", layers[0].cacheID)
+		}
+
+		humanReadable := "(sha256:" + string(sha) + ")"
+		if name, found := s.imageNameDB[sha]; found {
+			humanReadable = name
+		}
+		layerSha := shaSum(diff)
+		if _, exists := s.layerImageDB[layerSha]; !exists {
+			s.layerImageDB[layerSha] = make(map[string]struct{})
+			for _, layer := range layers {
+				if rawLayerMap[layer.cacheID] != nil {
+					s.layerRawDB[layerSha] = append(s.layerRawDB[layerSha], layer.cacheID)
+				}
+			}
+		}
+		s.layerImageDB[layerSha][humanReadable] = struct{}{}
+	}
+	return nil
+}
+
+func (s *Scanner) verifyImages(ctx context.Context, imageDBFolder, layerDBFolder, imageOS string, layerMap map[string][]*layerDBItem, rawLayerMap map[string]*rawLayerType) error {
+	files, err := s.FS.ReadDir(imageDBFolder)
+	if err != nil {
+		return fmt.Errorf("Error: failed to read files in %s: %v", imageDBFolder, err)
+	}
+	for i, f := range files {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		s.progress("images", i+1, len(files))
+		if !f.IsDir() {
+			s.imageCount++
+			imagePath := filepath.Join(imageDBFolder, f.Name())
+			err := s.verifyLayersOfImage(ctx, imagePath, shaSum(f.Name()), layerMap, rawLayerMap, layerDBFolder, imageOS)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// on hosts running images for several OSes, one line per OS keeps the output readable
+	otherOSes := make([]string, 0, len(s.otherOSImages))
+	for imageOS := range s.otherOSImages {
+		otherOSes = append(otherOSes, imageOS)
+	}
+	sort.Strings(otherOSes)
+	for _, otherOS := range otherOSes {
+		s.logf("WARN: Skipped %d images with OS %q, only %q images are managed by %s\n", len(s.otherOSImages[otherOS]), otherOS, imageOS, s.Driver)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package leakcheck
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanMaxChainDepth(t *testing.T) {
+	// image-0 is the child of image-1 and so on, only image-4 is tagged
+	f := newFixture()
+	var images []string
+	for i := 0; i < 5; i++ {
+		images = append(images, f.image(fmt.Sprintf("image:%d", i), digest(fmt.Sprint("layer", i))))
+	}
+	f.tags = map[string]string{"image:latest": "sha256:" + images[4]}
+	f.writeTags()
+	for i := 0; i < 4; i++ {
+		f.fs.write(filepath.Join(f.folders.ImageMetaData, images[i], "parent"), "sha256:"+images[i+1])
+	}
+
+	s := f.scanner()
+	s.MaxChainDepth = 4
+	_, err := s.Scan(context.Background(), f.folders.Root)
+	if err == nil {
+		t.Fatalf("Scan() succeeded, expected the chain of %s to exceed the maximum depth", images[0])
+	}
+	want := fmt.Sprintf("inheritance chain of image %s exceeds the maximum depth of 4", images[0])
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("Scan() error = %v, expected it to contain %q", err, want)
+	}
+
+	s.MaxChainDepth = 5
+	if _, err := s.Scan(context.Background(), f.folders.Root); err != nil {
+		t.Errorf("Scan() error = %v with a chain within the maximum depth", err)
+	}
+}
+
+func TestImageConfigs(t *testing.T) {
+	f := newFixture()
+	app := f.image("app:latest", digest("base"), digest("app"))
+	f.fs.write(filepath.Join(f.folders.ImageDB, "win"), `{"os":"windows","architecture":"amd64","rootfs":{"type":"layers","diff_ids":["`+digest("win")+`"]}}`)
+
+	s := f.scanner()
+	if _, err := s.Scan(context.Background(), f.folders.Root); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	configs := s.ImageConfigs()
+	if got, want := configs[app], (ImageConfig{Name: "app:latest", OS: "linux", LayerCount: 2}); got != want {
+		t.Errorf("ImageConfigs()[app] = %+v, expected %+v", got, want)
+	}
+	if got, want := configs["win"], (ImageConfig{OS: "windows", Architecture: "amd64", LayerCount: 1}); got != want {
+		t.Errorf("ImageConfigs()[win] = %+v, expected %+v", got, want)
+	}
+}
+
+func TestUntaggedImages(t *testing.T) {
+	f := newFixture()
+	f.image("app:latest", digest("base"))
+	untagged := f.image("", digest("untagged"))
+	used := f.image("", digest("used"))
+	// an untagged parent with an untagged child is a dangling chain, neither of them is an untagged leaf image
+	parent := f.image("", digest("parent"))
+	child := f.image("", digest("parent"), digest("child"))
+	f.fs.write(filepath.Join(f.folders.ImageMetaData, child, "parent"), "sha256:"+parent)
+	f.fs.write(filepath.Join(f.folders.Container, "c1", "config.v2.json"), `{"Image":"sha256:`+used+`"}`)
+
+	s := f.scanner()
+	result, err := s.Scan(context.Background(), f.folders.Root)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	assertLayers(t, "dangling images", result.DanglingImages, []string{parent})
+
+	images, err := s.UntaggedImages(f.folders.ImageDB)
+	if err != nil {
+		t.Fatalf("UntaggedImages() error = %v", err)
+	}
+	assertLayers(t, "untagged images", images, []string{untagged, used})
+
+	removable, err := s.RemovableImages(f.folders)
+	if err != nil {
+		t.Fatalf("RemovableImages() error = %v", err)
+	}
+	assertLayers(t, "removable images", removable, []string{untagged})
+}
+
+func TestExplainHistoryWithoutRootFS(t *testing.T) {
+	s := NewScanner("overlay2")
+	s.Verbosity = 1
+	// must not panic, whatever order the checks of an image run in
+	s.explainHistory("abc", &imageType{OS: "linux", History: []historyEntry{{CreatedBy: "RUN true"}}})
+}
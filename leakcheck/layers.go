@@ -0,0 +1,282 @@
+package leakcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type layerDBItem struct {
+	ID      string
+	diff    string
+	cacheID string
+	visited bool
+}
+
+type rawLayerType struct {
+	ID                 string
+	visited            bool
+	visitedByImage     bool
+	visitedByContainer bool
+	// link is set for junctions and symbolic links that are not followed, see Scanner.NoFollow.
+	link bool
+}
+
+// Kinds of folders found next to the layers in the raw layer folder.
+const (
+	rawLayerKindLayer   = "layer"
+	rawLayerKindSandbox = "sandbox"
+	rawLayerKindTemp    = "temp"
+	rawLayerKindPartial = "partial"
+)
+
+// rawLayerMarkers are the files or folders that every genuine layer of a storage driver contains.
+var rawLayerMarkers = map[string][]string{
+	"windowsfilter": {"Files", "layer.vhd"},
+	"overlay2":      {"diff"},
+}
+
+// isPartialDownload reports whether the name of a folder in the raw layer folder is the one of a temporary folder
+// of a pull, e.g. tmp-123 or 123.tmp. Interrupted pulls leave these behind.
+func isPartialDownload(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "tmp") || strings.HasPrefix(name, ".tmp") || strings.HasSuffix(name, ".tmp")
+}
+
+// classifyRawLayer tells genuine layers apart from container sandboxes, partial downloads and temporary folders, e.g.
+// left behind while a layer was being extracted. Only genuine layers are reported as unreferenced.
+func (s *Scanner) classifyRawLayer(rawLayerFolder, name string) string {
+	if isPartialDownload(name) {
+		return rawLayerKindPartial
+	}
+	if strings.HasSuffix(name, "-init") || exists(s.FS, filepath.Join(rawLayerFolder, name, "sandbox.vhdx")) {
+		return rawLayerKindSandbox
+	}
+	markers, known := rawLayerMarkers[s.Driver]
+	if !known {
+		return rawLayerKindLayer
+	}
+	for _, marker := range markers {
+		if exists(s.FS, filepath.Join(rawLayerFolder, name, marker)) {
+			return rawLayerKindLayer
+		}
+	}
+	return rawLayerKindTemp
+}
+
+// createRawLayerMap enumerates the on-disk layers. Entries that can't be inspected, e.g. due to transient locks, are
+// recorded as skipped rather than failing the whole enumeration.
+func (s *Scanner) createRawLayerMap(ctx context.Context, rawLayerFolder string) (map[string]*rawLayerType, error) {
+	entries, err := s.FS.ReadDir(rawLayerFolder)
+	if err != nil {
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("Error: failed to read files in %s: %v", rawLayerFolder, err)
+		}
+		s.skippedRawLayers = append(s.skippedRawLayers, fmt.Sprintf("%s (enumeration incomplete: %v)", rawLayerFolder, err))
+	}
+	var mu sync.Mutex
+	var rawLayerMap = make(map[string]*rawLayerType)
+	done := 0
+	err = runPool(ctx, s.Concurrency, len(entries), func(i int) error {
+		e := entries[i]
+		f, err := e.Info()
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		s.progress("on-disk layers", done, len(entries))
+		if err != nil {
+			s.skippedRawLayers = append(s.skippedRawLayers, fmt.Sprintf("%s (%v)", e.Name(), err))
+			return nil
+		}
+		// relocated layers are junctions or symbolic links, which are classified by their target. Removing them only
+		// ever removes the link itself.
+		if IsLink(f) {
+			if s.NoFollow {
+				// the link still counts as a present layer, so the images using it can be verified
+				s.logf("Info: Not following junction or symbolic link %s in %s\n", f.Name(), rawLayerFolder)
+				rawLayerMap[f.Name()] = &rawLayerType{ID: f.Name(), link: true}
+				return nil
+			}
+			target, err := s.FS.Stat(filepath.Join(rawLayerFolder, f.Name()))
+			if err != nil {
+				s.skippedRawLayers = append(s.skippedRawLayers, fmt.Sprintf("%s (broken link: %v)", f.Name(), err))
+				return nil
+			}
+			s.logf("Info: Following junction or symbolic link %s in %s\n", f.Name(), rawLayerFolder)
+			f = target
+		}
+		// overlay2 keeps shortened symlinks to its layers in the 'l' folder
+		if f.IsDir() && f.Name() != "l" {
+			rawLayer := &rawLayerType{}
+			rawLayer.ID = f.Name()
+			rawLayerMap[rawLayer.ID] = rawLayer
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rawLayerMap, nil
+}
+
+// missingLayerDBFiles returns which of the files a well-formed layerDB entry consists of are missing. Only base
+// layers, whose chain ID is identical to their diff, don't have a parent.
+func missingLayerDBFiles(fsys FileSystem, entryFolder string) []string {
+	var missing []string
+	for _, name := range []string{"diff", "cache-id", "size"} {
+		if !exists(fsys, filepath.Join(entryFolder, name)) {
+			missing = append(missing, name)
+		}
+	}
+	dat, err := fsys.ReadFile(filepath.Join(entryFolder, "diff"))
+	if err == nil && strings.TrimSpace(string(dat)) != "sha256:"+filepath.Base(entryFolder) && !exists(fsys, filepath.Join(entryFolder, "parent")) {
+		missing = append(missing, "parent")
+	}
+	return missing
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readLayerDBEntry reads the diff and cache-id of a single layerDB entry. If the entry is incomplete, the names of the
+// missing files are returned as well. Entries without a diff or cache-id can't be used and are returned as nil.
+func (s *Scanner) readLayerDBEntry(layerDBFolder, name string) (*layerDBItem, []string, error) {
+	layer := &layerDBItem{}
+	layer.ID = name
+
+	missing := missingLayerDBFiles(s.FS, filepath.Join(layerDBFolder, name))
+	if contains(missing, "diff") || contains(missing, "cache-id") {
+		return nil, missing, nil
+	}
+
+	diffFile := filepath.Join(layerDBFolder, name, "diff")
+	dat, err := s.FS.ReadFile(diffFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error: failed to read file %s: %v", diffFile, err)
+	}
+	layer.diff = strings.TrimSpace(string(dat))
+
+	cacheIDFile := filepath.Join(layerDBFolder, name, "cache-id")
+	dat, err = s.FS.ReadFile(cacheIDFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error: failed to read file %s: %v", cacheIDFile, err)
+	}
+	layer.cacheID = strings.TrimSpace(string(dat))
+	return layer, missing, nil
+}
+
+// populateLayerDBMap reads the layerDB entries using up to Concurrency workers and maps them by their diff. Several
+// entries can share a diff, e.g. identical empty layers in different images, and are sorted by their ID.
+func (s *Scanner) populateLayerDBMap(ctx context.Context, layerDBFolder string) (map[string][]*layerDBItem, error) {
+	// enumerate the existing layers in the LayerDB
+	files, err := s.FS.ReadDir(layerDBFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to read files in %s: %v", layerDBFolder, err)
+	}
+	var mu sync.Mutex
+	var layerMap = make(map[string][]*layerDBItem)
+	done := 0
+	err = runPool(ctx, s.Concurrency, len(files), func(i int) error {
+		f := files[i]
+		if !f.IsDir() {
+			return nil
+		}
+		layer, missing, err := s.readLayerDBEntry(layerDBFolder, f.Name())
+		if err != nil && s.Strict {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		s.progress("layerDB entries", done, len(files))
+		if err != nil {
+			s.skipLayerDBEntry(layerDBFolder, f.Name(), err)
+			return nil
+		}
+		if len(missing) != 0 {
+			s.logf("Error: Incomplete layerDB entry %s, missing: %s\n", f.Name(), strings.Join(missing, ", "))
+			s.incompleteLayerDB[f.Name()] = missing
+		}
+		if layer != nil {
+			layerMap[layer.diff] = append(layerMap[layer.diff], layer)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, layers := range layerMap {
+		sort.Slice(layers, func(i, j int) bool { return layers[i].ID < layers[j].ID })
+	}
+	return layerMap, nil
+}
+
+// skipLayerDBEntry records a layerDB entry that could not be read, to be reported along with the result. Its cache-id
+// is read if possible, so its on-disk layer isn't taken for a leak.
+func (s *Scanner) skipLayerDBEntry(layerDBFolder, name string, err error) {
+	s.unreadableLayerDB[name] = strings.TrimPrefix(err.Error(), "Error: ")
+	dat, err := s.FS.ReadFile(filepath.Join(layerDBFolder, name, "cache-id"))
+	if err != nil {
+		s.logf("WARN: On-disk layer of layerDB entry %s is unknown, it may be reported as unreferenced\n", name)
+		return
+	}
+	s.unreadableCacheIDs = append(s.unreadableCacheIDs, strings.TrimSpace(string(dat)))
+}
+
+// findMissingRawLayers records the layerDB entries whose cache-id doesn't point to an existing on-disk layer. This is
+// the inverse of an unreferenced layer: metadata that points at nothing.
+func (s *Scanner) findMissingRawLayers(rawLayerFolder string, layerMap map[string][]*layerDBItem, rawLayerMap map[string]*rawLayerType) {
+	for _, layers := range layerMap {
+		for _, layer := range layers {
+			if rawLayerMap[layer.cacheID] != nil {
+				continue
+			}
+			// the layer may have been skipped while enumerating the raw layer folder
+			if layer.cacheID != "" && exists(s.FS, filepath.Join(rawLayerFolder, layer.cacheID)) {
+				continue
+			}
+			s.missingRawLayers[layer.ID] = layer.cacheID
+		}
+	}
+}
+
+// verifyLayerOrdering checks that the layerDB entries of an image are chained together in the order given by its
+// diff_ids. Each layerDB entry is named after its chain ID, which is derived from the chain ID of its parent and its
+// own diff, and records the chain ID of its parent in a 'parent' file.
+func verifyLayerOrdering(fsys FileSystem, layerDBFolder string, diffIDs []string) error {
+	const shaPrefix = "sha256:"
+	var parent string
+	for i, diff := range diffIDs {
+		chainID := diff
+		if i > 0 {
+			h := sha256.Sum256([]byte(parent + " " + diff))
+			chainID = shaPrefix + hex.EncodeToString(h[:])
+		}
+		layerFolder := filepath.Join(layerDBFolder, strings.TrimPrefix(chainID, shaPrefix))
+		if !exists(fsys, layerFolder) {
+			return fmt.Errorf("no layerDB entry %s for diff %s at position %d", chainID, diff, i)
+		}
+		if i > 0 {
+			dat, err := fsys.ReadFile(filepath.Join(layerFolder, "parent"))
+			if err != nil {
+				return fmt.Errorf("failed to read parent of layer %s: %v", chainID, err)
+			}
+			if actual := strings.TrimSpace(string(dat)); actual != parent {
+				return fmt.Errorf("layer %s has parent %s, expected %s", chainID, actual, parent)
+			}
+		}
+		parent = chainID
+	}
+	return nil
+}
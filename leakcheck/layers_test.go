@@ -0,0 +1,46 @@
+package leakcheck
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanTrimsLayerDBFiles(t *testing.T) {
+	f := newFixture()
+	f.image("app:latest", digest("base"))
+	entry := filepath.Join(f.folders.LayerDB, strings.TrimPrefix(digest("base"), "sha256:"))
+	f.fs.write(filepath.Join(entry, "diff"), digest("base")+"\n")
+	f.fs.write(filepath.Join(entry, "cache-id"), "app-latest-0\r\n")
+
+	result, err := f.scanner().Scan(context.Background(), f.folders.Root)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	assertLayers(t, "unreferenced layers", result.UnreferencedLayers, nil)
+	assertLayers(t, "unreferenced raw layers", result.UnreferencedRawLayers, nil)
+}
+
+func TestPopulateLayerDBMapSharedDiff(t *testing.T) {
+	// an empty layer at different positions of two images has the same diff, but a different chain ID
+	f := newFixture()
+	f.image("first:1", digest("first"), digest("empty"))
+	f.image("second:1", digest("second"), digest("empty"))
+
+	s := f.scanner()
+	layerMap, err := s.populateLayerDBMap(context.Background(), f.folders.LayerDB)
+	if err != nil {
+		t.Fatalf("populateLayerDBMap() error = %v", err)
+	}
+	if layers := layerMap[digest("empty")]; len(layers) != 2 {
+		t.Fatalf("populateLayerDBMap() has %d entries for the shared diff, expected 2", len(layers))
+	}
+
+	result, err := s.Scan(context.Background(), f.folders.Root)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	assertLayers(t, "unreferenced layers", result.UnreferencedLayers, nil)
+	assertLayers(t, "unreferenced raw layers", result.UnreferencedRawLayers, nil)
+}
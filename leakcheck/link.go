@@ -0,0 +1,10 @@
+//go:build !windows
+
+package leakcheck
+
+import "io/fs"
+
+// IsLink reports whether a file, as returned by Lstat, is a symbolic link.
+func IsLink(info fs.FileInfo) bool {
+	return info.Mode()&fs.ModeSymlink != 0
+}
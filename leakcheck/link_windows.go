@@ -0,0 +1,20 @@
+//go:build windows
+
+package leakcheck
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// IsLink reports whether a file, as returned by Lstat, is a symbolic link or a junction. Since Go 1.23, junctions are
+// reported as irregular files rather than symbolic links, so any reparse point counts as a link.
+func IsLink(info fs.FileInfo) bool {
+	if info.Mode()&(fs.ModeSymlink|fs.ModeIrregular) != 0 {
+		return true
+	}
+	if attrs, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return attrs.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT != 0
+	}
+	return false
+}
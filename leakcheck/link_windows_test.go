@@ -0,0 +1,55 @@
+//go:build windows
+
+package leakcheck
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// makeJunction creates a junction at link pointing to the folder target.
+func makeJunction(t *testing.T, target, link string) {
+	t.Helper()
+	if out, err := exec.Command("cmd", "/c", "mklink", "/J", link, target).CombinedOutput(); err != nil {
+		t.Skipf("failed to create junction: %v: %s", err, out)
+	}
+}
+
+func TestIsLinkJunction(t *testing.T) {
+	dir := t.TempDir()
+	rawLayerFolder := filepath.Join(dir, "windowsfilter")
+	target := filepath.Join(dir, "relocated")
+	for _, folder := range []string{filepath.Join(rawLayerFolder, "layer"), target} {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	junction := filepath.Join(rawLayerFolder, "junction")
+	makeJunction(t, target, junction)
+
+	for path, want := range map[string]bool{junction: true, target: false} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IsLink(info); got != want {
+			t.Errorf("IsLink(%s) = %v, expected %v", path, got, want)
+		}
+	}
+
+	s := NewScanner("windowsfilter")
+	s.NoFollow = true
+	rawLayerMap, err := s.createRawLayerMap(context.Background(), rawLayerFolder)
+	if err != nil {
+		t.Fatalf("createRawLayerMap() error = %v", err)
+	}
+	if layer := rawLayerMap["junction"]; layer == nil || !layer.link {
+		t.Errorf("createRawLayerMap() = %+v for the junction, expected an unfollowed link", layer)
+	}
+	if layer := rawLayerMap["layer"]; layer == nil || layer.link {
+		t.Errorf("createRawLayerMap() = %+v for the folder, expected a regular layer", layer)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package leakcheck
+
+// LongPath returns the path unchanged. Only Windows limits the length of paths.
+func LongPath(path string) string {
+	return path
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package leakcheck
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxShortPath is the length from which paths need the extended-length prefix. Folders are limited to 248 characters,
+// files to 260, so the lower limit is used for both.
+const maxShortPath = 248
+
+// LongPath adds the \\?\ prefix to absolute paths that are too long for the regular Windows API, so deeply nested
+// layer trees can still be read.
+func LongPath(path string) string {
+	if len(path) < maxShortPath || strings.HasPrefix(path, `\\?\`) || !filepath.IsAbs(path) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		// UNC path, \\server\share becomes \\?\UNC\server\share
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package leakcheck
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	long := strings.Repeat(`\layer`, 50)
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"short path", `C:\ProgramData\docker`, `C:\ProgramData\docker`},
+		{"long path", `C:\ProgramData\docker` + long, `\\?\C:\ProgramData\docker` + long},
+		{"long UNC path", `\\server\share` + long, `\\?\UNC\server\share` + long},
+		{"already prefixed", `\\?\C:\docker` + long, `\\?\C:\docker` + long},
+		{"relative path", `docker` + long, `docker` + long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LongPath(tt.path); got != tt.want {
+				t.Errorf("LongPath() = %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
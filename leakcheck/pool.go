@@ -0,0 +1,48 @@
+package leakcheck
+
+import (
+	"context"
+	"sync"
+)
+
+// runPool calls work for every index in [0, n), running up to concurrency calls in parallel. The first error cancels
+// the remaining work and is returned. Callers have to synchronize any state shared between the calls themselves.
+func runPool(ctx context.Context, concurrency, n int, work func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			if err := work(i); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return canceled(ctx)
+}
@@ -0,0 +1,441 @@
+// Package leakcheck finds invalid images and unreferenced layers in the storage of a Docker runtime.
+package leakcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+type shaSum string
+
+// Scanner inspects a Docker runtime root. It keeps the image and layer databases of the last scan around, so they can
+// be queried afterwards.
+type Scanner struct {
+	// Driver is the storage driver of the Docker runtime, e.g. windowsfilter or overlay2.
+	Driver string
+	// Strict enables additional consistency checks on the layerDB and aborts the scan on the first layerDB entry that
+	// can't be read. Otherwise unreadable entries are skipped and recorded.
+	Strict bool
+	// SkipInheritance skips resolving the names of unnamed child images through the imagedb metadata.
+	SkipInheritance bool
+	// MaxChainDepth is the number of images an inheritance chain may consist of. Longer chains abort the scan, as they
+	// hint at corrupted metadata. Zero or less disables the limit.
+	MaxChainDepth int
+	// NoFollow stops treating junctions and symbolic links in the raw layer folder as the layers they point to. They
+	// still count as present layers for the images using them, but are never classified or reported as unreferenced.
+	NoFollow bool
+	// ExcludeImages are filepath.Match patterns of image names. The layers of matching images are not taken as used,
+	// so they are reported as unreferenced unless another image uses them as well.
+	ExcludeImages []string
+	// Log receives the warnings and diagnostics found during a scan.
+	Log io.Writer
+	// Verbosity is the level of the debug messages written to Log. At 1, the layers every image resolves to are shown,
+	// at 2 also every file that is read and every layer that is marked as used.
+	Verbosity int
+	// Concurrency is the number of layerDB entries and on-disk layers that are read in parallel.
+	Concurrency int
+	// Progress, if set, is called while scanning with the number of entries of a stage that were processed so far, e.g.
+	// "layerDB entries". It may be called concurrently.
+	Progress func(stage string, done, total int)
+	// FS is where the metadata of the Docker runtime root is read from. Defaults to the disk.
+	FS FileSystem
+
+	// Reverse lookup of image sha sums to names. For logging purposes.
+	imageNameDB map[shaSum]string
+	// Map of layers to image names. Unfortunately, Go doesn't have sets, hence we must use a map for the values.
+	layerImageDB map[shaSum]map[string]struct{}
+	// Map of layers used by images to the on-disk layers holding them. Identical layers can be stored more than once.
+	layerRawDB map[shaSum][]string
+	// Map of the layerDB entries used by images to their diff.
+	layerDiffs map[string]shaSum
+	// Map of child image sha sums to their parent image, as recorded in the imagedb metadata.
+	imageParentDB map[shaSum]shaSum
+	// Resolved inheritance chains, from a child image up to the topmost ancestor that could be found.
+	inheritanceChainDB map[shaSum][]shaSum
+	// Map of image sha sums to the summary of their config.
+	imageConfigDB map[shaSum]ImageConfig
+
+	imageCount           int
+	layerCount           int
+	rawLayerCount        int
+	incompleteLayerDB    map[string][]string
+	unreadableLayerDB    map[string]string
+	unreadableCacheIDs   []string
+	otherOSImages        map[string][]shaSum
+	staleTags            map[string]string
+	dualReferencedLayers []string
+	skippedRawLayers     []string
+	sandboxRawLayers     []string
+	tempRawLayers        []string
+	partialRawLayers     []string
+	missingRawLayers     map[string]string
+	danglingImages       []shaSum
+	danglingChains       map[shaSum][][]shaSum
+	pinnedLayers         []string
+	inconsistentImages   []shaSum
+	phases               []Phase
+}
+
+// Phase is the wall-clock duration of one phase of a scan.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Result holds the findings of a scan.
+type Result struct {
+	Folder string
+	Driver string
+	// Number of images, layerDB entries and on-disk layers that were scanned.
+	ImageCount    int
+	LayerCount    int
+	RawLayerCount int
+	// LayerDB entries and on-disk layers that are not referenced by any image or container.
+	UnreferencedLayers    []string
+	UnreferencedRawLayers []string
+	// LayerDB entries that are no longer referenced by any image, but whose on-disk layer is still used by a container.
+	PinnedLayers []string
+	// On-disk layers that are referenced by an image as well as by a container.
+	DualReferencedLayers []string
+	// Entries of the raw layer folder that could not be inspected, and the reason why.
+	SkippedRawLayers []string
+	// Unreferenced folders in the raw layer folder that are container sandboxes or temporary folders rather than
+	// layers. These are not included in UnreferencedRawLayers.
+	SandboxRawLayers []string
+	TempRawLayers    []string
+	// Unreferenced folders in the raw layer folder named like the temporary folders of a pull. Interrupted pulls leave
+	// them behind, they are always safe to remove. These are not included in UnreferencedRawLayers either.
+	PartialRawLayers []string
+	// LayerDB entries that are missing some of their expected files, mapped to the names of the missing files.
+	IncompleteLayers map[string][]string
+	// LayerDB entries that could not be read, mapped to the error. They are skipped unless Strict is set.
+	UnreadableLayers map[string]string
+	// LayerDB entries whose cache-id points to an on-disk layer that doesn't exist, mapped to the cache-id.
+	MissingRawLayers map[string]string
+	// Images whose diff_ids don't match the parent chain in the layerDB. Only populated in strict mode.
+	InconsistentImages []string
+	// Root images of inheritance chains that don't have a name.
+	DanglingImages []string
+	// The inheritance chains leading to every dangling image, from the youngest child up to the dangling image.
+	DanglingChains map[string][][]string
+	// Folders in the imagedb metadata whose image no longer exists.
+	OrphanedMetadata []string
+	// Tags in repositories.json whose image no longer exists in the imagedb, mapped to the sha of the image.
+	StaleTags map[string]string
+	// Durations of the phases of the scan, in the order they ran.
+	Phases []Phase
+}
+
+// DefaultMaxChainDepth is the default limit of the number of images in an inheritance chain.
+const DefaultMaxChainDepth = 128
+
+func NewScanner(driver string) *Scanner {
+	s := &Scanner{Driver: driver, Log: ioutil.Discard, FS: OSFileSystem{}, Concurrency: runtime.NumCPU(), MaxChainDepth: DefaultMaxChainDepth}
+	s.reset()
+	return s
+}
+
+// reset clears the state left behind by a previous scan.
+func (s *Scanner) reset() {
+	s.imageNameDB = make(map[shaSum]string)
+	s.layerImageDB = make(map[shaSum]map[string]struct{})
+	s.layerRawDB = make(map[shaSum][]string)
+	s.layerDiffs = make(map[string]shaSum)
+	s.imageParentDB = make(map[shaSum]shaSum)
+	s.inheritanceChainDB = make(map[shaSum][]shaSum)
+	s.imageConfigDB = make(map[shaSum]ImageConfig)
+	s.imageCount = 0
+	s.layerCount = 0
+	s.rawLayerCount = 0
+	s.incompleteLayerDB = make(map[string][]string)
+	s.unreadableLayerDB = make(map[string]string)
+	s.unreadableCacheIDs = nil
+	s.otherOSImages = make(map[string][]shaSum)
+	s.staleTags = make(map[string]string)
+	s.dualReferencedLayers = nil
+	s.skippedRawLayers = nil
+	s.sandboxRawLayers = nil
+	s.tempRawLayers = nil
+	s.partialRawLayers = nil
+	s.missingRawLayers = make(map[string]string)
+	s.danglingImages = nil
+	s.danglingChains = make(map[shaSum][][]shaSum)
+	s.pinnedLayers = nil
+	s.inconsistentImages = nil
+	s.phases = nil
+}
+
+// timePhase records the duration of a phase that started at start.
+func (s *Scanner) timePhase(name string, start time.Time) {
+	s.phases = append(s.phases, Phase{Name: name, Duration: time.Since(start)})
+}
+
+func (s *Scanner) progress(stage string, done, total int) {
+	if s.Progress != nil {
+		s.Progress(stage, done, total)
+	}
+}
+
+func (s *Scanner) logf(format string, a ...interface{}) {
+	fmt.Fprintf(s.Log, format, a...)
+}
+
+func (s *Scanner) logln(a ...interface{}) {
+	fmt.Fprintln(s.Log, a...)
+}
+
+// debugf writes a debug message if the verbosity is at least the given level.
+func (s *Scanner) debugf(level int, format string, a ...interface{}) {
+	if s.Verbosity >= level {
+		fmt.Fprintf(s.Log, "Debug: "+format, a...)
+	}
+}
+
+// Folders returns the locations inside the given Docker runtime root that are inspected by the scanner, using the
+// metadata layout of the driver that is present in the root.
+func (s *Scanner) Folders(folder string) Folders {
+	folders, _ := detectFolders(s.FS, folder, s.Driver)
+	return folders
+}
+
+// Scan inspects the given Docker runtime root and returns the layers that are no longer referenced. The scan stops
+// between directory entries once ctx is done, returning an error that wraps ctx.Err().
+func (s *Scanner) Scan(ctx context.Context, folder string) (Result, error) {
+	found, err := stat(s.FS, folder)
+	if err != nil {
+		return Result{}, err
+	}
+	if !found {
+		return Result{}, sentinelf(ErrFolderMissing, "Error: folder does not exist")
+	}
+	if s.Verbosity >= 2 {
+		fsys := s.FS
+		s.FS = tracingFS{FileSystem: fsys, s: s}
+		defer func() { s.FS = fsys }()
+	}
+	folders, detected := detectFolders(s.FS, folder, s.Driver)
+	if structureErrors := folders.structureErrors(s.FS); len(structureErrors) != 0 {
+		if !detected {
+			structureErrors = append(structureErrors, layoutError(s.FS, folder, s.Driver))
+		}
+		return Result{}, sentinelf(ErrBadLayout, "%s", strings.Join(folders.withHeader(structureErrors), "\n"))
+	}
+
+	if err := s.LoadImageNames(folders); err != nil {
+		return Result{}, err
+	}
+	unreferencedLayers, unreferencedRawLayers, err := s.verifyImagesAndLayers(ctx, folders)
+	if err != nil {
+		return Result{}, err
+	}
+	orphanedMetadata, err := s.findOrphanedMetadata(folders.ImageMetaData, folders.ImageDB)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{
+		Folder:                folder,
+		Driver:                s.Driver,
+		ImageCount:            s.imageCount,
+		LayerCount:            s.layerCount,
+		RawLayerCount:         s.rawLayerCount,
+		UnreferencedLayers:    unreferencedLayers,
+		UnreferencedRawLayers: unreferencedRawLayers,
+		PinnedLayers:          s.pinnedLayers,
+		DualReferencedLayers:  s.dualReferencedLayers,
+		SkippedRawLayers:      s.skippedRawLayers,
+		SandboxRawLayers:      s.sandboxRawLayers,
+		TempRawLayers:         s.tempRawLayers,
+		PartialRawLayers:      s.partialRawLayers,
+		IncompleteLayers:      s.incompleteLayerDB,
+		UnreadableLayers:      s.unreadableLayerDB,
+		MissingRawLayers:      s.missingRawLayers,
+		OrphanedMetadata:      orphanedMetadata,
+		StaleTags:             s.staleTags,
+		Phases:                s.phases,
+	}
+	for _, sha := range s.inconsistentImages {
+		result.InconsistentImages = append(result.InconsistentImages, string(sha))
+	}
+	seen := make(map[shaSum]struct{})
+	for _, sha := range s.danglingImages {
+		if _, dup := seen[sha]; !dup {
+			seen[sha] = struct{}{}
+			result.DanglingImages = append(result.DanglingImages, string(sha))
+		}
+	}
+	result.DanglingChains = make(map[string][][]string, len(s.danglingChains))
+	for parent, chains := range s.danglingChains {
+		all := make([][]string, 0, len(chains))
+		for _, chain := range chains {
+			links := make([]string, 0, len(chain))
+			for _, sha := range chain {
+				links = append(links, string(sha))
+			}
+			all = append(all, links)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i][0] < all[j][0] })
+		result.DanglingChains[string(parent)] = all
+	}
+	sort.Strings(result.UnreferencedLayers)
+	sort.Strings(result.UnreferencedRawLayers)
+	sort.Strings(result.PinnedLayers)
+	sort.Strings(result.DualReferencedLayers)
+	sort.Strings(result.SandboxRawLayers)
+	sort.Strings(result.TempRawLayers)
+	sort.Strings(result.PartialRawLayers)
+	return result, nil
+}
+
+// ImageName returns the human readable name of an image, if it has one.
+func (s *Scanner) ImageName(sha string) (string, bool) {
+	name, found := s.imageNameDB[shaSum(strings.TrimPrefix(sha, "sha256:"))]
+	return name, found
+}
+
+// LayerImages returns, for every layer referenced by an image in the last scan, the names of the images using it.
+// Images without a name are listed by their sha.
+func (s *Scanner) LayerImages() map[string][]string {
+	layerImages := make(map[string][]string, len(s.layerImageDB))
+	for layer, images := range s.layerImageDB {
+		names := make([]string, 0, len(images))
+		for img := range images {
+			names = append(names, img)
+		}
+		sort.Strings(names)
+		layerImages[string(layer)] = names
+	}
+	return layerImages
+}
+
+// LayerRawFolders returns the names of the on-disk layers holding every layer that is used by an image, keyed like
+// LayerImages.
+func (s *Scanner) LayerRawFolders() map[string][]string {
+	layerRaw := make(map[string][]string, len(s.layerRawDB))
+	for layer, folders := range s.layerRawDB {
+		layerRaw[string(layer)] = append([]string{}, folders...)
+	}
+	return layerRaw
+}
+
+// LayerUsers returns the diff of a layer and the images using it. The layer can be given by its diff, the ID of its
+// layerDB entry or the name of its on-disk layer (cache-id), with or without sha256: prefix. Only valid after Scan.
+func (s *Scanner) LayerUsers(layer string) (string, []string, bool) {
+	id := strings.TrimPrefix(strings.TrimSpace(layer), "sha256:")
+	diff := shaSum("sha256:" + id)
+	if _, found := s.layerImageDB[diff]; !found {
+		diff = ""
+		if chainDiff, found := s.layerDiffs[id]; found {
+			diff = chainDiff
+		}
+		for d, cacheIDs := range s.layerRawDB {
+			if diff == "" && contains(cacheIDs, id) {
+				diff = d
+			}
+		}
+	}
+	images, found := s.layerImageDB[diff]
+	if !found {
+		return "", nil, false
+	}
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return string(diff), names, true
+}
+
+// canceled returns a wrapped error if ctx is done, so callers can tell a cancellation from a data error.
+func canceled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Error: scan canceled: %w", err)
+	}
+	return nil
+}
+
+func (s *Scanner) verifyImagesAndLayers(ctx context.Context, folders Folders) ([]string, []string, error) {
+	start := time.Now()
+	rawLayerMap, err := s.createRawLayerMap(ctx, folders.RawLayer)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.timePhase("createRawLayerMap", start)
+
+	start = time.Now()
+	layerMap, err := s.populateLayerDBMap(ctx, folders.LayerDB)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.timePhase("populateLayerDBMap", start)
+	for _, layers := range layerMap {
+		s.layerCount += len(layers)
+	}
+	s.rawLayerCount = len(rawLayerMap)
+	// the on-disk layers of unreadable layerDB entries can't be attributed to an image, they are kept rather than
+	// reported as unreferenced
+	for _, cacheID := range s.unreadableCacheIDs {
+		if rawLayer := rawLayerMap[cacheID]; rawLayer != nil {
+			rawLayer.visited = true
+		}
+	}
+
+	start = time.Now()
+	err = s.verifyImages(ctx, folders.ImageDB, folders.LayerDB, folders.ImageOS(), layerMap, rawLayerMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.timePhase("verifyImages", start)
+
+	start = time.Now()
+	err = s.visitContainerLayers(ctx, folders.Container, folders.Mounts, folders.RawLayer, rawLayerMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.timePhase("visitContainerLayers", start)
+
+	s.findMissingRawLayers(folders.RawLayer, layerMap, rawLayerMap)
+
+	var unreferencedLayers []string
+	for _, layers := range layerMap {
+		for _, layer := range layers {
+			if layer.visited == false {
+				// No image references this layer anymore, but it may still be in use by a container.
+				if rawLayer := rawLayerMap[layer.cacheID]; rawLayer != nil && rawLayer.visitedByContainer {
+					s.pinnedLayers = append(s.pinnedLayers, layer.ID)
+					continue
+				}
+				unreferencedLayers = append(unreferencedLayers, layer.ID)
+			}
+		}
+	}
+
+	var unreferencedRawLayers []string
+	for _, rawLayer := range rawLayerMap {
+		if rawLayer.visited == false && rawLayer.link {
+			// an unfollowed link is never classified nor removed, that would require looking at its target
+			s.skippedRawLayers = append(s.skippedRawLayers, fmt.Sprintf("%s (unreferenced link, not followed)", rawLayer.ID))
+		} else if rawLayer.visited == false {
+			switch s.classifyRawLayer(folders.RawLayer, rawLayer.ID) {
+			case rawLayerKindSandbox:
+				s.sandboxRawLayers = append(s.sandboxRawLayers, rawLayer.ID)
+			case rawLayerKindTemp:
+				s.tempRawLayers = append(s.tempRawLayers, rawLayer.ID)
+			case rawLayerKindPartial:
+				s.partialRawLayers = append(s.partialRawLayers, rawLayer.ID)
+			default:
+				unreferencedRawLayers = append(unreferencedRawLayers, rawLayer.ID)
+			}
+		}
+		if rawLayer.visitedByImage && rawLayer.visitedByContainer {
+			s.dualReferencedLayers = append(s.dualReferencedLayers, rawLayer.ID)
+		}
+	}
+	return unreferencedLayers, unreferencedRawLayers, nil
+}
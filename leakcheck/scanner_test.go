@@ -0,0 +1,314 @@
+package leakcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory FileSystem backed by a map of paths to file contents. Folders are created implicitly for
+// every file, empty folders with mkdir.
+type memFS struct {
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte), dirs: make(map[string]bool)}
+}
+
+func (m *memFS) mkdir(name string) {
+	for name = filepath.Clean(name); !m.dirs[name]; name = filepath.Dir(name) {
+		m.dirs[name] = true
+	}
+}
+
+func (m *memFS) write(name, content string) {
+	name = filepath.Clean(name)
+	m.mkdir(filepath.Dir(name))
+	m.files[name] = []byte(content)
+}
+
+func (m *memFS) remove(name string) {
+	delete(m.files, filepath.Clean(name))
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: filepath.Base(dir), dir: true}))
+		}
+	}
+	for file, content := range m.files {
+		if filepath.Dir(file) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: filepath.Base(file), size: int64(len(content))}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	content, found := m.files[filepath.Clean(name)]
+	if !found {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	if content, found := m.files[name]; found {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(content))}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// fixture builds an overlay2 Docker runtime root in a memFS.
+type fixture struct {
+	fs      *memFS
+	folders Folders
+	tags    map[string]string
+}
+
+func newFixture() *fixture {
+	f := &fixture{fs: newMemFS(), folders: NewFolders(filepath.FromSlash("/docker"), "overlay2"), tags: make(map[string]string)}
+	for _, folder := range []string{f.folders.ImageDB, f.folders.ImageMetaData, f.folders.LayerDB, f.folders.RawLayer, f.folders.Container} {
+		f.fs.mkdir(folder)
+	}
+	f.writeTags()
+	return f
+}
+
+func (f *fixture) writeTags() {
+	dat, _ := json.Marshal(repositories{Repositories: map[string]map[string]string{"test": f.tags}})
+	f.fs.write(f.folders.RepoJson, string(dat))
+}
+
+func digest(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// layer adds a layerDB entry and its on-disk layer, and returns the chain ID of the entry. Like Docker, images share
+// the entries of identical parent chains.
+func (f *fixture) layer(parent, diff, cacheID string) string {
+	chainID := diff
+	if parent != "" {
+		chainID = digest(parent + " " + diff)
+	}
+	entry := filepath.Join(f.folders.LayerDB, strings.TrimPrefix(chainID, "sha256:"))
+	if f.fs.dirs[entry] {
+		return chainID
+	}
+	f.fs.write(filepath.Join(entry, "diff"), diff)
+	f.fs.write(filepath.Join(entry, "cache-id"), cacheID)
+	f.fs.write(filepath.Join(entry, "size"), "100")
+	if parent != "" {
+		f.fs.write(filepath.Join(entry, "parent"), parent)
+	}
+	f.rawLayer(cacheID)
+	return chainID
+}
+
+func (f *fixture) rawLayer(cacheID string) {
+	f.fs.write(filepath.Join(f.folders.RawLayer, cacheID, "diff", "file"), "content")
+}
+
+// image adds an image with the given diffs along with its layers, and tags it unless the tag is empty. The cache-ids
+// are derived from the tag and position of the layer. It returns the sha of the image.
+func (f *fixture) image(tag string, diffs ...string) string {
+	config, _ := json.Marshal(imageType{OS: "linux", RootFS: &rootFS{Type: "layers", DiffIDs: diffs}})
+	sha := strings.TrimPrefix(digest(string(config)), "sha256:")
+	f.fs.write(filepath.Join(f.folders.ImageDB, sha), string(config))
+	var parent string
+	for i, diff := range diffs {
+		parent = f.layer(parent, diff, fmt.Sprintf("%s-%d", strings.ReplaceAll(tag, ":", "-"), i))
+	}
+	if tag != "" {
+		f.tags[tag] = "sha256:" + sha
+		f.writeTags()
+	}
+	return sha
+}
+
+func (f *fixture) scanner() *Scanner {
+	s := NewScanner("overlay2")
+	s.FS = f.fs
+	return s
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name           string
+		build          func(f *fixture)
+		wantLayers     []string
+		wantRawLayers  []string
+		wantIncomplete []string
+		wantErr        error
+		wantErrText    string
+	}{
+		{
+			name: "clean root",
+			build: func(f *fixture) {
+				f.image("app:latest", digest("base"), digest("app"))
+				f.image("tool:1", digest("base"))
+			},
+		},
+		{
+			name: "leaky root",
+			build: func(f *fixture) {
+				f.image("app:latest", digest("base"), digest("app"))
+				f.layer("", digest("removed"), "leaked")
+				f.rawLayer("rawonly")
+			},
+			wantLayers:    []string{strings.TrimPrefix(digest("removed"), "sha256:")},
+			wantRawLayers: []string{"leaked", "rawonly"},
+		},
+		{
+			name: "container layers are used",
+			build: func(f *fixture) {
+				f.image("app:latest", digest("base"))
+				f.rawLayer("mount")
+				f.rawLayer("mount-init")
+				f.fs.mkdir(filepath.Join(f.folders.Container, "c1"))
+				f.fs.write(filepath.Join(f.folders.Mounts, "c1", "mount-id"), "mount")
+				f.fs.write(filepath.Join(f.folders.Mounts, "c1", "init-id"), "mount-init")
+			},
+		},
+		{
+			name: "missing repositories.json",
+			build: func(f *fixture) {
+				f.fs.remove(f.folders.RepoJson)
+			},
+			wantErr: ErrBadLayout,
+		},
+		{
+			name: "missing layerDB entry",
+			build: func(f *fixture) {
+				f.fs.write(filepath.Join(f.folders.ImageDB, "abc"), `{"os":"linux","rootfs":{"type":"layers","diff_ids":["`+digest("gone")+`"]}}`)
+			},
+			wantErrText: "expected layer with diff " + digest("gone"),
+		},
+		{
+			name: "image without rootfs",
+			build: func(f *fixture) {
+				f.fs.write(filepath.Join(f.folders.ImageDB, "abc"), `{"os":"linux"}`)
+			},
+			wantErrText: "image abc has no rootfs",
+		},
+		{
+			name: "missing cache-id",
+			build: func(f *fixture) {
+				f.image("app:latest", digest("base"))
+				entry := f.layer("", digest("broken"), "broken")
+				f.fs.remove(filepath.Join(f.folders.LayerDB, strings.TrimPrefix(entry, "sha256:"), "cache-id"))
+			},
+			wantRawLayers:  []string{"broken"},
+			wantIncomplete: []string{strings.TrimPrefix(digest("broken"), "sha256:")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture()
+			tt.build(f)
+			result, err := f.scanner().Scan(context.Background(), f.folders.Root)
+			if tt.wantErr != nil || tt.wantErrText != "" {
+				if err == nil {
+					t.Fatalf("Scan() succeeded, expected an error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Scan() error = %v, expected %v", err, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Errorf("Scan() error = %v, expected it to contain %q", err, tt.wantErrText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			assertLayers(t, "unreferenced layers", result.UnreferencedLayers, tt.wantLayers)
+			assertLayers(t, "unreferenced raw layers", result.UnreferencedRawLayers, tt.wantRawLayers)
+			var incomplete []string
+			for layer := range result.IncompleteLayers {
+				incomplete = append(incomplete, layer)
+			}
+			assertLayers(t, "incomplete layers", incomplete, tt.wantIncomplete)
+		})
+	}
+}
+
+// assertLayers compares two lists of layers regardless of their order.
+func assertLayers(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	got = append([]string{}, got...)
+	want = append([]string{}, want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, expected %v", what, got, want)
+	}
+}
+
+// BenchmarkScan scans a root with 5000 layers, 50 images with 100 layers each, serially and with a pool of workers.
+func BenchmarkScan(b *testing.B) {
+	f := newFixture()
+	for i := 0; i < 50; i++ {
+		diffs := make([]string, 100)
+		for j := range diffs {
+			diffs[j] = digest(fmt.Sprintf("layer %d of image %d", j, i))
+		}
+		f.image(fmt.Sprintf("image:%d", i), diffs...)
+	}
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			s := f.scanner()
+			s.Concurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Scan(context.Background(), f.folders.Root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package leakcheck
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxTarFileSize is the size up to which the contents of files are kept in memory. The metadata read by the scanner is
+// small, the files of the layers themselves are only listed.
+const maxTarFileSize = 1 << 20
+
+// IsTarArchive reports whether the given root is a tar archive rather than a folder.
+func IsTarArchive(root string) bool {
+	if !strings.EqualFold(filepath.Ext(root), ".tar") {
+		return false
+	}
+	info, err := os.Stat(LongPath(root))
+	return err == nil && info.Mode().IsRegular()
+}
+
+type tarEntry struct {
+	info     fs.FileInfo
+	data     []byte
+	children map[string]*tarEntry
+}
+
+// TarFileSystem reads a Docker runtime root from a tar archive, e.g. an offline copy of a broken host. Paths are
+// resolved relative to the path of the archive, so the archive can be passed to Scan like a folder. If the archive
+// holds the root in a single top level folder, that folder is taken as the root.
+type TarFileSystem struct {
+	archive string
+	root    *tarEntry
+}
+
+// NewTarFileSystem reads the directory tree of the given tar archive.
+func NewTarFileSystem(archive string) (*TarFileSystem, error) {
+	f, err := os.Open(LongPath(archive))
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to open archive %s: %v", archive, err)
+	}
+	defer f.Close()
+	archiveInfo, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Error: failed to open archive %s: %v", archive, err)
+	}
+
+	t := &TarFileSystem{archive: archive, root: newTarDir(".", archiveInfo.ModTime())}
+	r := tar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to read archive %s: %v", archive, err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		entry := &tarEntry{info: header.FileInfo()}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.children = make(map[string]*tarEntry)
+		case tar.TypeReg:
+			if header.Size <= maxTarFileSize {
+				entry.data, err = io.ReadAll(r)
+				if err != nil {
+					return nil, fmt.Errorf("Error: failed to read %s from archive %s: %v", header.Name, archive, err)
+				}
+			}
+		}
+		t.add(name, entry)
+	}
+
+	// archives created from the parent folder hold the root in a single folder
+	if _, found := t.root.children["image"]; !found && len(t.root.children) == 1 {
+		for _, child := range t.root.children {
+			if _, found := child.children["image"]; found {
+				t.root = child
+			}
+		}
+	}
+	return t, nil
+}
+
+func newTarDir(name string, modTime time.Time) *tarEntry {
+	header := &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}
+	return &tarEntry{info: header.FileInfo(), children: make(map[string]*tarEntry)}
+}
+
+// add inserts an entry, creating the folders leading to it if the archive doesn't list them.
+func (t *TarFileSystem) add(name string, entry *tarEntry) {
+	dir := t.root
+	elements := strings.Split(name, "/")
+	for _, element := range elements[:len(elements)-1] {
+		child := dir.children[element]
+		if child == nil || child.children == nil {
+			child = newTarDir(element, t.root.info.ModTime())
+			dir.children[element] = child
+		}
+		dir = child
+	}
+	last := elements[len(elements)-1]
+	if existing := dir.children[last]; existing != nil && existing.children != nil && entry.children != nil {
+		// keep the entries of a folder that was created implicitly before
+		entry.children = existing.children
+	}
+	dir.children[last] = entry
+}
+
+func (t *TarFileSystem) lookup(name string) (*tarEntry, error) {
+	rel, err := filepath.Rel(t.archive, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entry := t.root
+	if rel != "." {
+		for _, element := range strings.Split(filepath.ToSlash(rel), "/") {
+			if entry.children == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			if entry = entry.children[element]; entry == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+		}
+	}
+	return entry, nil
+}
+
+// ReadDir returns the entries of a folder in the archive, sorted by name.
+func (t *TarFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := t.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	entries := make([]fs.DirEntry, 0, len(entry.children))
+	for _, child := range entry.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadFile returns the contents of a file in the archive. Only the contents of small files are available.
+func (t *TarFileSystem) ReadFile(name string) ([]byte, error) {
+	entry, err := t.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.children != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	if entry.data == nil && entry.info.Size() != 0 {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("file too large to read from an archive")}
+	}
+	return entry.data, nil
+}
+
+func (t *TarFileSystem) Stat(name string) (fs.FileInfo, error) {
+	entry, err := t.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}